@@ -0,0 +1,672 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/flock"
+
+	"uploadfish/config"
+	"uploadfish/models"
+	"uploadfish/storage"
+)
+
+const adminUsage = `Usage:
+  uploadfish [--config FILE] [command]
+
+Commands:
+  serve                      Run the server (the default)
+  gc                         Delete expired files and compact the database
+  stats                      Show database statistics
+  ls [flags]                 List stored files, filtered by type, size, upload
+                             time, encryption or expiry mode
+  rm ID...                   Delete files
+  inspect ID                 Show a file's stored metadata
+  export [-o FILE]           Write all files and API keys to a tar archive
+  import [-overwrite] [FILE]
+                             Load files and API keys from an export archive
+  apikey ...                 Manage API keys
+  config check               Validate the configuration and print the
+                             effective settings
+
+Settings are read from environment variables, which override the YAML or
+TOML file given with --config. Commands other than serve and config open the
+database directly with the same settings as the server, and must be run while
+it is stopped. Expired files are only removed by gc.
+`
+
+// Entries in an export archive. Each file's metadata comes directly before
+// its content, so an archive can be imported in a single pass.
+const (
+	exportFilesDir   = "files/"
+	exportAPIKeysDir = "apikeys/"
+	exportMetaExt    = ".json"
+	exportContentExt = ".content"
+)
+
+// adminPageSize is how many files stats and export read from a listing at once
+const adminPageSize = 1000
+
+// cliStorageLogger implements the storage.Logger interface for admin
+// commands, reporting only errors so command output stays readable
+type cliStorageLogger struct{}
+
+func (l *cliStorageLogger) Error(err error, message string, fields map[string]interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+}
+
+func (l *cliStorageLogger) Info(message string, fields map[string]interface{}) {}
+
+// openAdminStorage opens the storage for an admin command. Bitcask allows a
+// single process at a time, so this fails while the server is running. The
+// cleanup routine isn't started, so only gc removes expired files.
+func openAdminStorage(cfg *config.Config) (*storage.Storage, error) {
+	store, err := storage.Open(cfg, &cliStorageLogger{})
+	if err != nil {
+		if errors.Is(err, bitcask.ErrDatabaseLocked) || errors.Is(err, flock.ErrLockFailed) {
+			return nil, fmt.Errorf("the database at %s is in use, stop the server first", cfg.BitcaskPath)
+		}
+		return nil, err
+	}
+	return store, nil
+}
+
+// runCommand runs an admin command instead of the server and returns the
+// process exit code
+func runCommand(name string, args []string) int {
+	switch name {
+	case "apikey":
+		return runAPIKeyCommand(args)
+	case "config":
+		return runConfigCommand(args)
+	}
+
+	commands := map[string]func(*storage.Storage, []string) error{
+		"gc":      gcCommand,
+		"stats":   statsCommand,
+		"ls":      lsCommand,
+		"rm":      rmCommand,
+		"inspect": inspectCommand,
+		"export":  exportCommand,
+		"import":  importCommand,
+	}
+	command, ok := commands[name]
+	if !ok {
+		if name == "help" || name == "-h" || name == "--help" {
+			fmt.Print(adminUsage)
+			return 0
+		}
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+	store, err := openAdminStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if err := command(store, args); err != nil {
+		if err != errUsage {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// configPath is the config file given with --config, if any
+var configPath string
+
+// parseGlobalFlags parses the flags shared by the server and the admin
+// commands and returns the remaining arguments, exiting on invalid flags
+func parseGlobalFlags(args []string) []string {
+	flags := flag.NewFlagSet("uploadfish", flag.ContinueOnError)
+	flags.StringVar(&configPath, "config", configPath, "")
+	flags.Usage = func() {}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(adminUsage)
+			os.Exit(0)
+		}
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+	return flags.Args()
+}
+
+// runConfigCommand runs "uploadfish config check", which validates the
+// configuration and prints every setting with where its value came from
+func runConfigCommand(args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  uploadfish [--config FILE] config check")
+		return 2
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	if configPath != "" {
+		fmt.Printf("Config file: %s\n\n", configPath)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, setting := range cfg.Settings() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", setting.Name, setting.Value, setting.Source)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// errUsage is returned after a command has printed its usage
+var errUsage = errors.New("invalid usage")
+
+// parseAdminFlags parses a command's flags, requiring at least minArgs and at
+// most maxArgs positional arguments (no limit if maxArgs is negative)
+func parseAdminFlags(flags *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if flags.NArg() < minArgs || (maxArgs >= 0 && flags.NArg() > maxArgs) {
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// gcCommand deletes expired files and merges the database to reclaim space
+func gcCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	if err := parseAdminFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	before, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	expired, err := store.ListExpiredFiles()
+	if err != nil {
+		return err
+	}
+	if err := store.CleanupExpiredFiles(); err != nil {
+		return err
+	}
+	// Cleanup only merges when files were removed; gc always compacts
+	if len(expired) == 0 {
+		if err := store.Merge(); err != nil {
+			return err
+		}
+	}
+	after, err := store.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d expired files\n", len(expired))
+	fmt.Printf("Database size %s -> %s\n", formatSize(before.Size), formatSize(after.Size))
+	return nil
+}
+
+// statsCommand prints database statistics
+func statsCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	if err := parseAdminFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	var contentSize int64
+	var files, encrypted int
+	err = eachFile(store, func(file *models.File) error {
+		files++
+		contentSize += file.Size
+		if file.IsEncrypted {
+			encrypted++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Files:\t%d (%d encrypted)\n", files, encrypted)
+	fmt.Fprintf(tw, "Content size:\t%s\n", formatSize(contentSize))
+	fmt.Fprintf(tw, "Database keys:\t%d\n", stats.Keys)
+	fmt.Fprintf(tw, "Database size:\t%s\n", formatSize(stats.Size))
+	fmt.Fprintf(tw, "Data files:\t%d\n", stats.Datafiles)
+	return tw.Flush()
+}
+
+// eachFile calls fn for every stored file, oldest first, reading the listing
+// a page at a time so large databases aren't held in memory
+func eachFile(store *storage.Storage, fn func(*models.File) error) error {
+	filter := storage.FileFilter{Limit: adminPageSize}
+	for {
+		list, err := store.ListFiles(filter)
+		if err != nil {
+			return err
+		}
+		for _, file := range list.Files {
+			if err := fn(file); err != nil {
+				return err
+			}
+		}
+		if list.NextCursor == "" {
+			return nil
+		}
+		filter.Cursor = list.NextCursor
+	}
+}
+
+// lsCommand lists stored files, optionally filtered
+func lsCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print one JSON object per file")
+	mimePrefix := flags.String("type", "", "Only files whose MIME type starts with this, e.g. image/")
+	minSize := flags.Int64("min-size", 0, "Only files of at least this many bytes")
+	maxSize := flags.Int64("max-size", 0, "Only files of at most this many bytes")
+	after := flags.String("after", "", "Only files uploaded since this time (RFC 3339, or a duration ago such as 24h)")
+	before := flags.String("before", "", "Only files uploaded before this time (RFC 3339, or a duration ago such as 24h)")
+	encrypted := flags.String("encrypted", "", "Only encrypted (true) or unencrypted (false) files")
+	expiryMode := flags.String("expiry-mode", "", "Only files that expire by time or also after downloads (time or downloads)")
+	limit := flags.Int("limit", 0, "Show at most this many files (0 for all)")
+	cursor := flags.String("cursor", "", "Continue a listing from the cursor printed after a page")
+	if err := parseAdminFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	filter := storage.FileFilter{
+		MimePrefix: *mimePrefix,
+		MinSize:    *minSize,
+		MaxSize:    *maxSize,
+		ExpiryMode: *expiryMode,
+		Limit:      *limit,
+		Cursor:     *cursor,
+	}
+	var err error
+	if filter.UploadedAfter, err = parseTimeFlag(*after); err != nil {
+		return fmt.Errorf("invalid -after: %w", err)
+	}
+	if filter.UploadedBefore, err = parseTimeFlag(*before); err != nil {
+		return fmt.Errorf("invalid -before: %w", err)
+	}
+	if *encrypted != "" {
+		value, err := strconv.ParseBool(*encrypted)
+		if err != nil {
+			return fmt.Errorf("invalid -encrypted: %w", err)
+		}
+		filter.Encrypted = &value
+	}
+
+	list, err := store.ListFiles(filter)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, file := range list.Files {
+			if err := enc.Encode(file); err != nil {
+				return err
+			}
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSIZE\tUPLOADED\tEXPIRES\tENCRYPTED\tTYPE\tFILENAME")
+		for _, file := range list.Files {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+				file.ID, formatSize(file.Size), file.UploadTime.Format(time.RFC3339),
+				describeExpiry(file), file.IsEncrypted, file.MimeType, file.Filename)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if list.NextCursor != "" {
+		fmt.Fprintf(os.Stderr, "More files match, continue with -cursor %s\n", list.NextCursor)
+	}
+	return nil
+}
+
+// parseTimeFlag parses an RFC 3339 time, or a duration meaning that long ago
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// rmCommand deletes files by ID
+func rmCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	if err := parseAdminFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	failed := false
+	for _, id := range flags.Args() {
+		if _, err := store.GetFile(id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, describeLookupError(err))
+			failed = true
+			continue
+		}
+		if err := store.DeleteFile(id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Deleted %s\n", id)
+	}
+	if failed {
+		return fmt.Errorf("some files could not be deleted")
+	}
+	return nil
+}
+
+// inspectCommand prints a file's stored metadata
+func inspectCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	if err := parseAdminFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+
+	file, err := store.GetFile(flags.Arg(0))
+	if err != nil {
+		return describeLookupError(err)
+	}
+
+	storedSize, err := store.StoredSize(file.ID)
+	var storedValue interface{} = storedSize
+	if err != nil {
+		storedValue = fmt.Sprintf("unavailable: %v", err)
+	}
+
+	out := struct {
+		*models.File
+		StoredSize interface{} `json:"stored_size"`
+		Expired    bool        `json:"expired"`
+	}{file, storedValue, !file.ExpiryTime.IsZero() && file.ExpiryTime.Before(time.Now())}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// exportCommand writes every file and API key to a tar archive
+func exportCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "-", "Archive to write, or - for standard output")
+	if err := parseAdminFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	keys, err := store.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(out)
+	exported := 0
+	err = eachFile(store, func(file *models.File) error {
+		content, err := store.GetFileContentStream(file.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", file.ID, err)
+			return nil
+		}
+		err = exportFile(tw, file, content)
+		content.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", file.ID, err)
+		}
+		exported++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, err := key.ToJSON()
+		if err != nil {
+			return err
+		}
+		if err := writeTarEntry(tw, exportAPIKeysDir+key.ID+exportMetaExt, data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if *output != "-" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d files and %d API keys\n", exported, len(keys))
+	return nil
+}
+
+// exportFile writes a file's metadata and its decoded content
+func exportFile(tw *tar.Writer, file *models.File, content io.Reader) error {
+	// How the content is stored is decided again on import
+	exported := *file
+	exported.Codec = ""
+	exported.ContentFrameSize = 0
+	exported.ContentIndex = nil
+
+	data, err := exported.ToJSON()
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, exportFilesDir+file.ID+exportMetaExt, data); err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:    exportFilesDir + file.ID + exportContentExt,
+		Mode:    0600,
+		Size:    file.Size,
+		ModTime: file.UploadTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	written, err := io.Copy(tw, content)
+	if err != nil {
+		return err
+	}
+	if written != file.Size {
+		return fmt.Errorf("content is %d bytes, expected %d", written, file.Size)
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// importCommand loads files and API keys from an export archive
+func importCommand(store *storage.Storage, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "Replace files and API keys that already exist. A file is deleted before its archived copy is imported, so it is lost if that import fails.")
+	if err := parseAdminFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if name := flags.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var pending *models.File // Metadata waiting for its content
+	imported, skipped, keys := 0, 0, 0
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		dir, name := path.Split(header.Name)
+		switch {
+		case dir == exportFilesDir && strings.HasSuffix(name, exportMetaExt):
+			file := &models.File{}
+			if err := readTarJSON(tr, file.FromJSON); err != nil {
+				return fmt.Errorf("invalid metadata %s: %w", header.Name, err)
+			}
+			pending = file
+
+		case dir == exportFilesDir && strings.HasSuffix(name, exportContentExt):
+			id := strings.TrimSuffix(name, exportContentExt)
+			if pending == nil || pending.ID != id {
+				return fmt.Errorf("content %s has no metadata before it", header.Name)
+			}
+			file := pending
+			pending = nil
+
+			if _, err := store.GetFile(file.ID); err == nil {
+				if !*overwrite {
+					skipped++
+					continue
+				}
+				// Saving over a file would leave parts of its old content
+				// behind, so it is deleted first
+				if err := store.DeleteFile(file.ID); err != nil {
+					return fmt.Errorf("failed to replace %s: %w", file.ID, err)
+				}
+			}
+			if err := store.SaveFile(context.Background(), file, tr); err != nil {
+				return fmt.Errorf("failed to import %s: %w", file.ID, err)
+			}
+			imported++
+
+		case dir == exportAPIKeysDir && strings.HasSuffix(name, exportMetaExt):
+			key := &models.APIKey{}
+			if err := readTarJSON(tr, key.FromJSON); err != nil {
+				return fmt.Errorf("invalid API key %s: %w", header.Name, err)
+			}
+			if _, err := store.GetAPIKeyByHash(key.KeyHash); err == nil && !*overwrite {
+				skipped++
+				continue
+			}
+			if err := store.SaveAPIKey(key); err != nil {
+				return fmt.Errorf("failed to import API key %s: %w", key.ID, err)
+			}
+			keys++
+
+		default:
+			fmt.Fprintf(os.Stderr, "Ignoring unknown entry %s\n", header.Name)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d files and %d API keys, skipped %d that already exist\n", imported, keys, skipped)
+	return nil
+}
+
+// readTarJSON reads a small JSON entry from an archive
+func readTarJSON(r io.Reader, decode func([]byte) error) error {
+	data, err := io.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return err
+	}
+	return decode(data)
+}
+
+// describeLookupError turns a missing file into a readable error
+func describeLookupError(err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("no such file")
+	}
+	return err
+}
+
+// describeExpiry summarises when a file expires
+func describeExpiry(file *models.File) string {
+	switch {
+	case file.ExpiryTime.IsZero():
+		return file.ExpiryValue
+	case file.ExpiryTime.Before(time.Now()):
+		return "expired"
+	}
+	expiry := file.ExpiryTime.Format(time.RFC3339)
+	if file.MaxDownloads > 0 {
+		expiry += fmt.Sprintf(" (%d/%d downloads left)", file.DownloadsRemaining, file.MaxDownloads)
+	}
+	return expiry
+}
+
+// formatSize formats a byte count for display
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
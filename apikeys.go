@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"uploadfish/config"
+	"uploadfish/storage"
+	"uploadfish/utils"
+)
+
+// runAPIKeyCommand runs "uploadfish apikey <create|list|revoke>" and returns
+// the process exit code
+func runAPIKeyCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  uploadfish apikey create -name NAME [-max-upload-size BYTES] [-expiry-options 24h,7d] [-default-expiry 24h] [-admin]")
+		fmt.Fprintln(os.Stderr, "  uploadfish apikey list")
+		fmt.Fprintln(os.Stderr, "  uploadfish apikey revoke ID")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		err = createAPIKey(cfg, args[1:])
+	case "list":
+		err = listAPIKeys(cfg)
+	case "revoke":
+		if len(args) != 2 {
+			usage()
+			return 2
+		}
+		err = revokeAPIKey(cfg, args[1])
+	default:
+		usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// createAPIKey generates a new API key and prints it once
+func createAPIKey(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+	name := flags.String("name", "", "Name describing who uses the key")
+	maxUploadSize := flags.Int64("max-upload-size", 0, "Maximum upload size in bytes, at most MAX_UPLOAD_SIZE (0 uses MAX_UPLOAD_SIZE)")
+	expiryOptions := flags.String("expiry-options", "", "Comma-separated expiry options for this key (empty uses EXPIRY_OPTIONS)")
+	defaultExpiry := flags.String("default-expiry", "", "Default expiry for this key (defaults to the first expiry option)")
+	admin := flags.Bool("admin", false, "Allow the key to use the admin API")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, secret, err := utils.NewAPIKey(*name)
+	if err != nil {
+		return err
+	}
+	key.MaxUploadSize = *maxUploadSize
+	key.DefaultExpiry = *defaultExpiry
+	key.Admin = *admin
+	for _, option := range strings.Split(*expiryOptions, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			key.ExpiryOptions = append(key.ExpiryOptions, option)
+		}
+	}
+	if err := key.Validate(cfg.MaxUploadSize, cfg.MaxRetention); err != nil {
+		return err
+	}
+
+	store, err := openAdminStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.SaveAPIKey(key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created API key %s (%s)\n", key.ID, key.Name)
+	fmt.Printf("Key: %s\n", secret)
+	fmt.Println("Store the key now, it cannot be shown again.")
+	return nil
+}
+
+// listAPIKeys prints the stored API keys without their secrets
+func listAPIKeys(cfg *config.Config) error {
+	store, err := openAdminStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	keys, err := store.ListAPIKeys()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCREATED\tADMIN\tMAX UPLOAD SIZE\tEXPIRY OPTIONS")
+	for _, key := range keys {
+		maxUploadSize := "default"
+		if key.MaxUploadSize > 0 {
+			maxUploadSize = fmt.Sprintf("%d", key.MaxUploadSize)
+		}
+		expiryOptions := "default"
+		if len(key.ExpiryOptions) > 0 {
+			expiryOptions = strings.Join(key.ExpiryOptions, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\t%s\n", key.ID, key.Name, key.CreatedAt.Format(time.RFC3339), key.Admin, maxUploadSize, expiryOptions)
+	}
+	return tw.Flush()
+}
+
+// revokeAPIKey deletes an API key so it can no longer be used
+func revokeAPIKey(cfg *config.Config, id string) error {
+	store, err := openAdminStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.DeleteAPIKey(id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("no API key with ID %s", id)
+		}
+		return err
+	}
+
+	fmt.Printf("Revoked API key %s\n", id)
+	return nil
+}
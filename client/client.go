@@ -0,0 +1,226 @@
+// Package client is a Go client for UploadFish. It uploads files with the
+// chunked upload protocol used by the browser, including optional
+// client-side encryption compatible with static/js/modules/encryption.js,
+// and downloads, inspects and deletes files.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultChunkSize is the chunk size used when Client.ChunkSize is unset
+	DefaultChunkSize = 8 << 20
+	// MaxChunks is the most chunks the server accepts for one upload
+	MaxChunks = 1 << 16
+	// MaxChunkSize is the largest chunk the server accepts, less room for
+	// the multipart form around it
+	MaxChunkSize = 80 << 20
+	// TokenWindow is how many chunk tokens ahead the server issues, which
+	// bounds how many chunks can usefully be uploaded at once
+	TokenWindow = 3
+	// DefaultMaxRetries is how often a failed request is retried
+	DefaultMaxRetries = 5
+)
+
+var csrfInputPattern = regexp.MustCompile(`name="csrf_token"[^>]*value="([^"]+)"`)
+
+// Client talks to an UploadFish server. The zero value is not usable; create
+// clients with New. Exported fields may be changed before the first request.
+type Client struct {
+	// BaseURL is the server address, e.g. "https://upload.example.com"
+	BaseURL string
+	// APIKey authenticates requests with "Authorization: Bearer" instead of
+	// a CSRF token, and applies the key's upload limits
+	APIKey string
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+	// ChunkSize is the size of each uploaded chunk
+	ChunkSize int64
+	// Concurrency is how many chunks are uploaded at once, at most TokenWindow
+	Concurrency int
+	// MaxRetries is how often a chunk is retried after a network error, a
+	// rate limit, a server error or a corrupted transfer
+	MaxRetries int
+
+	csrfMu     sync.Mutex
+	csrfToken  string
+	csrfCookie string
+}
+
+// Error is an error response from the server
+type Error struct {
+	StatusCode int
+	Code       string // Error code from the /api/v1 endpoints, if any
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// New creates a client for the server at baseURL
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", baseURL)
+	}
+
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		HTTPClient:  &http.Client{Timeout: 30 * time.Minute},
+		ChunkSize:   DefaultChunkSize,
+		Concurrency: TokenWindow,
+		MaxRetries:  DefaultMaxRetries,
+	}, nil
+}
+
+// newRequest creates a request to a server path with authentication added
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	return req, nil
+}
+
+// addCSRF adds the CSRF token and cookie to a form request. Requests made
+// with an API key don't need them.
+func (c *Client) addCSRF(ctx context.Context, req *http.Request) error {
+	if c.APIKey != "" {
+		return nil
+	}
+
+	token, cookie, err := c.csrf(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-CSRF-Token", token)
+	// The cookie is marked Secure, so send it directly rather than through
+	// a cookie jar, which would drop it on plain HTTP
+	req.AddCookie(&http.Cookie{Name: "csrf_token", Value: cookie})
+	return nil
+}
+
+// csrf fetches a CSRF token pair from the upload page, once per client
+func (c *Client) csrf(ctx context.Context) (string, string, error) {
+	c.csrfMu.Lock()
+	defer c.csrfMu.Unlock()
+
+	if c.csrfToken != "" {
+		return c.csrfToken, c.csrfCookie, nil
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch CSRF token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", responseError(resp)
+	}
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch CSRF token: %w", err)
+	}
+	match := csrfInputPattern.FindSubmatch(page)
+	if match == nil {
+		return "", "", fmt.Errorf("no CSRF token found on the upload page")
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "csrf_token" {
+			c.csrfCookie = cookie.Value
+		}
+	}
+	if c.csrfCookie == "" {
+		return "", "", fmt.Errorf("no CSRF cookie set by the upload page")
+	}
+
+	c.csrfToken = html.UnescapeString(string(match[1]))
+	return c.csrfToken, c.csrfCookie, nil
+}
+
+// responseError reads an error response in any of the server's formats
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	apiErr := &Error{StatusCode: resp.StatusCode}
+
+	var decoded struct {
+		Message string `json:"message"`
+		Error   struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &decoded) == nil {
+		apiErr.Code = decoded.Error.Code
+		apiErr.Message = decoded.Error.Message
+		if apiErr.Message == "" {
+			apiErr.Message = decoded.Message
+		}
+	}
+	if apiErr.Message == "" && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// retryable reports whether a failed request may succeed if sent again
+func retryable(err error) bool {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		// Network errors, but not a cancelled or expired context
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch {
+	case apiErr.StatusCode == http.StatusTooManyRequests, apiErr.StatusCode >= 500:
+		return true
+	case apiErr.StatusCode == http.StatusBadRequest && strings.Contains(apiErr.Message, "hash mismatch"):
+		// The chunk was corrupted in transit
+		return true
+	}
+	return false
+}
+
+// withRetries calls fn until it succeeds, fails with an error that is not
+// worth retrying, or MaxRetries is used up, backing off between attempts
+func (c *Client) withRetries(ctx context.Context, fn func() error) error {
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.MaxRetries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay < 15*time.Second {
+			delay *= 2
+		}
+	}
+}
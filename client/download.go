@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// ErrKeyRequired is returned when downloading an encrypted file without a key
+var ErrKeyRequired = errors.New("file is encrypted and the URL has no key")
+
+var fileIDPattern = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$`)
+
+// FileInfo describes a stored file, as returned by the /api/v1 endpoints
+type FileInfo struct {
+	ID                 string     `json:"id"`
+	Filename           string     `json:"filename"`
+	MimeType           string     `json:"mime_type"`
+	Size               int64      `json:"size"`
+	UploadTime         time.Time  `json:"upload_time"`
+	Expiry             string     `json:"expiry"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+	IsEncrypted        bool       `json:"is_encrypted"`
+	MaxDownloads       int        `json:"max_downloads,omitempty"`
+	DownloadsRemaining *int       `json:"downloads_remaining,omitempty"`
+	URL                string     `json:"url"`
+	DownloadURL        string     `json:"download_url"`
+}
+
+// ParseFileURL extracts the file ID and encryption key from a share URL such
+// as "https://upload.example.com/file/<id>#<key>". A bare file ID is also
+// accepted. The key is empty for unencrypted files.
+func ParseFileURL(fileURL string) (string, string, error) {
+	if fileIDPattern.MatchString(fileURL) {
+		return fileURL, "", nil
+	}
+
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid file URL: %w", err)
+	}
+	var id string
+	if _, err := fmt.Sscanf(u.Path, "/file/%s", &id); err != nil || !fileIDPattern.MatchString(id) {
+		return "", "", fmt.Errorf("invalid file URL %q", fileURL)
+	}
+	return id, u.Fragment, nil
+}
+
+// Info returns the metadata of a file. It does not count as a download.
+func (c *Client) Info(ctx context.Context, fileID string) (*FileInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/v1/files/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info FileInfo
+	if err := c.doJSON(req, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Download writes the contents of the file at fileURL to w, decrypting it
+// with the key from the URL's fragment if it is encrypted. Encrypted files
+// are held in memory while they are decrypted, as in the browser.
+func (c *Client) Download(ctx context.Context, fileURL string, w io.Writer) (*FileInfo, error) {
+	fileID, key, err := ParseFileURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	return c.DownloadWithKey(ctx, fileID, key, w)
+}
+
+// DownloadWithKey writes the contents of a file to w, decrypting it with key
+// if it is encrypted
+func (c *Client) DownloadWithKey(ctx context.Context, fileID, key string, w io.Writer) (*FileInfo, error) {
+	info, err := c.Info(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsEncrypted {
+		if key == "" {
+			return info, ErrKeyRequired
+		}
+		// Check the key before the download uses up one of a limited
+		// number of downloads
+		if err := c.checkKey(ctx, fileID, key); err != nil {
+			return info, err
+		}
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/file/"+url.PathEscape(fileID)+"?dl=true", nil)
+	if err != nil {
+		return info, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, responseError(resp)
+	}
+
+	if !info.IsEncrypted {
+		_, err := io.Copy(w, resp.Body)
+		return info, err
+	}
+
+	encrypted, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return info, err
+	}
+	plaintext, err := Decrypt(encrypted, key)
+	if err != nil {
+		return info, err
+	}
+	_, err = w.Write(plaintext)
+	return info, err
+}
+
+// checkKey decrypts a file's encrypted sample to check the key, as the
+// preview page does. Files uploaded without a sample are not checked.
+func (c *Client) checkKey(ctx context.Context, fileID, key string) error {
+	if _, err := DecodeKey(key); err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/file/"+url.PathEscape(fileID)+".sample", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	sample, err := io.ReadAll(io.LimitReader(resp.Body, SampleSize+IVSize+64))
+	if err != nil {
+		return err
+	}
+	_, err = Decrypt(sample, key)
+	return err
+}
+
+// Delete deletes a file with the delete token returned when it was uploaded
+func (c *Client) Delete(ctx context.Context, fileID, deleteToken string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, "/api/v1/files/"+url.PathEscape(fileID), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Delete-Token", deleteToken)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
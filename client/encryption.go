@@ -0,0 +1,120 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encryption parameters matching static/js/modules/encryption.js: AES-256-GCM
+// with a random 12 byte IV stored in front of the ciphertext, and the key
+// encoded as URL-safe base64 without padding in the share URL's fragment.
+const (
+	KeySize = 32
+	IVSize  = 12
+	TagSize = 16 // GCM authentication tag appended to the ciphertext
+
+	// SampleSize is how much of the start of a file is encrypted separately
+	// as the sample the preview page uses to check the key
+	SampleSize = 4096
+)
+
+// ErrDecryptionFailed is returned when content cannot be decrypted with a key
+var ErrDecryptionFailed = errors.New("decryption failed, the encryption key may be incorrect")
+
+// GenerateKey creates a random encryption key, encoded for a URL fragment
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return EncodeKey(key), nil
+}
+
+// EncodeKey encodes a raw key as URL-safe base64 without padding
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey decodes a key from a URL fragment. Standard and padded base64
+// are accepted too, as the browser does.
+func DecodeKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+	encoded = strings.NewReplacer("+", "-", "/", "_").Replace(encoded)
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid encryption key: %d bytes, expected %d", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts data with an encoded key, returning the IV followed by
+// the ciphertext
+func Encrypt(plaintext []byte, encodedKey string) ([]byte, error) {
+	iv := make([]byte, IVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	return encryptWithIV(plaintext, encodedKey, iv)
+}
+
+// encryptWithIV encrypts with a given IV. Resumed uploads reuse the IV of the
+// original attempt so the ciphertext matches the chunks already uploaded.
+func encryptWithIV(plaintext []byte, encodedKey string, iv []byte) ([]byte, error) {
+	gcm, err := newGCM(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != IVSize {
+		return nil, fmt.Errorf("invalid IV: %d bytes, expected %d", len(iv), IVSize)
+	}
+
+	out := make([]byte, IVSize, IVSize+len(plaintext)+gcm.Overhead())
+	copy(out, iv)
+	return gcm.Seal(out, iv, plaintext, nil), nil
+}
+
+// Decrypt decrypts data produced by Encrypt or the browser
+func Decrypt(data []byte, encodedKey string) ([]byte, error) {
+	gcm, err := newGCM(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < IVSize+gcm.Overhead() {
+		return nil, fmt.Errorf("encrypted data is too short (%d bytes)", len(data))
+	}
+
+	plaintext, err := gcm.Open(nil, data[:IVSize], data[IVSize:], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// EncryptSample encrypts the start of a file as the validation sample sent
+// with an encrypted upload
+func EncryptSample(plaintext []byte, encodedKey string) ([]byte, error) {
+	if len(plaintext) > SampleSize {
+		plaintext = plaintext[:SampleSize]
+	}
+	return Encrypt(plaintext, encodedKey)
+}
+
+func newGCM(encodedKey string) (cipher.AEAD, error) {
+	key, err := DecodeKey(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
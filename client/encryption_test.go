@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// browserEncrypt encrypts as static/js/modules/encryption.js does: AES-GCM
+// with the 12 byte IV in front of the ciphertext and its tag
+func browserEncrypt(t *testing.T, plaintext, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("aes.NewCipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("cipher.NewGCM: %v", err)
+	}
+	return gcm.Seal(append([]byte{}, iv...), iv, plaintext, nil)
+}
+
+func TestDecryptBrowserFormat(t *testing.T) {
+	key := bytes.Repeat([]byte{0xfb}, KeySize) // Encodes with both - and _
+	iv := []byte("twelve bytes")
+	plaintext := []byte("encrypted in the browser")
+	data := browserEncrypt(t, plaintext, key, iv)
+
+	for _, encoded := range []string{
+		base64.RawURLEncoding.EncodeToString(key), // As in share URLs
+		base64.URLEncoding.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(key),
+	} {
+		decrypted, err := Decrypt(data, encoded)
+		if err != nil {
+			t.Fatalf("Decrypt with key %q: %v", encoded, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decrypt with key %q: got %q, want %q", encoded, decrypted, plaintext)
+		}
+	}
+}
+
+func TestEncryptBrowserFormat(t *testing.T) {
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	if strings.ContainsAny(encoded, "+/=") {
+		t.Errorf("key %q is not URL-safe base64 without padding", encoded)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		t.Fatalf("key %q does not decode to %d bytes: %v", encoded, KeySize, err)
+	}
+
+	plaintext := []byte("decrypted in the browser")
+	data, err := Encrypt(plaintext, encoded)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if len(data) != IVSize+len(plaintext)+TagSize {
+		t.Fatalf("encrypted %d bytes to %d, want the IV, ciphertext and tag", len(plaintext), len(data))
+	}
+	if want := browserEncrypt(t, plaintext, key, data[:IVSize]); !bytes.Equal(data, want) {
+		t.Errorf("Encrypt does not match the browser's format")
+	}
+
+	decrypted, err := Decrypt(data, encoded)
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("round trip: got %q, %v", decrypted, err)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	key, _ := GenerateKey()
+	other, _ := GenerateKey()
+	data, err := Encrypt([]byte("secret"), key)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := Decrypt(data, other); err != ErrDecryptionFailed {
+		t.Errorf("Decrypt with the wrong key: got %v, want ErrDecryptionFailed", err)
+	}
+}
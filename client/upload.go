@@ -0,0 +1,648 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// UploadOptions configures an upload
+type UploadOptions struct {
+	Filename     string // Defaults to "file"
+	ContentType  string // Detected from the filename or content if empty
+	Expiry       string // One of the server's expiry options, empty for the default
+	MaxDownloads int    // 0 for unlimited
+
+	// Encrypt encrypts the file before it is sent. The whole file is held in
+	// memory while it is encrypted, as in the browser.
+	Encrypt bool
+	// Key is the encoded key to encrypt with. A random key is generated if
+	// it is empty.
+	Key string
+
+	// Progress is called after each chunk with the bytes uploaded so far
+	Progress func(uploaded, total int64)
+	// OnSession is called once the server has accepted the first chunk,
+	// with the details needed to resume the upload if it is interrupted
+	OnSession func(*Session)
+	// Resume continues an earlier upload of the same file. The upload starts
+	// over if the server no longer has it.
+	Resume *Session
+}
+
+// ErrResumeMismatch is returned when the upload being resumed was of different
+// content, so it has to be started over
+var ErrResumeMismatch = errors.New("the interrupted upload does not match this file")
+
+// Session identifies an upload in progress so it can be resumed
+type Session struct {
+	FileID      string `json:"file_id"`
+	ResumeToken string `json:"resume_token"`
+	ChunkSize   int64  `json:"chunk_size"`
+	Key         string `json:"key,omitempty"` // Encryption key, for encrypted uploads
+	IV          []byte `json:"iv,omitempty"`  // Encryption IV, for encrypted uploads
+}
+
+// UploadResult describes a finished upload
+type UploadResult struct {
+	FileID      string
+	URL         string // Share URL, including the key fragment for encrypted files
+	DeleteToken string
+	Key         string // Encryption key, for encrypted files
+}
+
+// chunkResponse is the server's reply to a chunk or finalize request
+type chunkResponse struct {
+	Status             string   `json:"status"`
+	FileID             string   `json:"file_id"`
+	ResumeToken        string   `json:"resume_token"`
+	InitialChunkTokens []string `json:"initial_chunk_tokens"`
+	NextChunkTokens    []string `json:"next_chunk_tokens"`
+	RedirectURL        string   `json:"redirect_url"`
+	DeleteToken        string   `json:"delete_token"`
+}
+
+// statusResponse is the server's reply to an upload status request
+type statusResponse struct {
+	FileSize      int64             `json:"file_size"`
+	TotalChunks   int               `json:"total_chunks"`
+	MissingChunks []int             `json:"missing_chunks"`
+	ChunkHashes   map[string]string `json:"chunk_hashes"`
+	ChunkTokens   map[string]string `json:"chunk_tokens"`
+	FinalizeToken string            `json:"finalize_token"`
+}
+
+// upload is the state of a single chunked upload
+type upload struct {
+	client      *Client
+	src         io.ReaderAt
+	size        int64
+	chunkSize   int64
+	totalChunks int
+	opts        UploadOptions
+	contentType string
+	sample      []byte // Encrypted sample sent with chunk 0
+
+	// The file before encryption, kept so it can be encrypted again
+	plain     io.ReaderAt
+	plainSize int64
+	head      []byte
+
+	session *Session
+	tokens  map[int]string // Chunk tokens by index; the token for totalChunks finalizes
+}
+
+// UploadFile uploads a file from disk
+func (c *Client) UploadFile(ctx context.Context, path string, opts UploadOptions) (*UploadResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Filename == "" {
+		opts.Filename = filepath.Base(path)
+	}
+	return c.Upload(ctx, f, info.Size(), opts)
+}
+
+// Upload uploads size bytes read from src with the chunked upload protocol
+func (c *Client) Upload(ctx context.Context, src io.ReaderAt, size int64, opts UploadOptions) (*UploadResult, error) {
+	if opts.Filename == "" {
+		opts.Filename = "file"
+	}
+
+	u := &upload{
+		client:    c,
+		src:       src,
+		size:      size,
+		chunkSize: c.ChunkSize,
+		opts:      opts,
+		tokens:    make(map[int]string),
+		plain:     src,
+		plainSize: size,
+	}
+	if opts.Resume != nil && opts.Resume.ChunkSize > 0 {
+		// Chunk boundaries must match the interrupted upload
+		u.chunkSize = opts.Resume.ChunkSize
+	}
+	if u.chunkSize <= 0 {
+		u.chunkSize = DefaultChunkSize
+	}
+	if u.chunkSize > MaxChunkSize {
+		u.chunkSize = MaxChunkSize
+	}
+	if minimum := (size + MaxChunks - 1) / MaxChunks; u.chunkSize < minimum {
+		u.chunkSize = minimum
+	}
+
+	u.head = make([]byte, min(size, SampleSize))
+	if _, err := src.ReadAt(u.head, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	u.contentType = detectContentType(opts.ContentType, opts.Filename, u.head)
+
+	if opts.Encrypt {
+		// A resumed upload must encrypt with the key and IV of the
+		// interrupted one so the ciphertext matches the chunks already sent
+		key, iv := opts.Key, []byte(nil)
+		if opts.Resume != nil && opts.Resume.Key != "" {
+			key, iv = opts.Resume.Key, opts.Resume.IV
+		}
+		if err := u.encrypt(key, iv); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.size == 0 {
+		return u.uploadEmpty(ctx)
+	}
+	u.totalChunks = int((u.size + u.chunkSize - 1) / u.chunkSize)
+
+	pending, err := u.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.uploadChunks(ctx, pending); err != nil {
+		return nil, err
+	}
+	return u.finalize(ctx)
+}
+
+// encrypt replaces the source with the file encrypted with key and iv, and
+// prepares the encrypted sample. An empty key or nil IV is generated.
+func (u *upload) encrypt(key string, iv []byte) error {
+	if key == "" {
+		var err error
+		if key, err = GenerateKey(); err != nil {
+			return err
+		}
+	}
+	if iv == nil {
+		iv = make([]byte, IVSize)
+		if _, err := rand.Read(iv); err != nil {
+			return fmt.Errorf("failed to generate IV: %w", err)
+		}
+	}
+
+	plaintext := make([]byte, u.plainSize)
+	if _, err := u.plain.ReadAt(plaintext, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	encrypted, err := encryptWithIV(plaintext, key, iv)
+	if err != nil {
+		return err
+	}
+	sample, err := EncryptSample(u.head, key)
+	if err != nil {
+		return err
+	}
+
+	u.session = &Session{ChunkSize: u.chunkSize, Key: key, IV: iv}
+	u.src = bytes.NewReader(encrypted)
+	u.size = int64(len(encrypted))
+	u.sample = sample
+	return nil
+}
+
+// start resumes the upload if possible, or uploads chunk 0 to begin a new
+// one. It returns the chunks that still need to be uploaded.
+func (u *upload) start(ctx context.Context) ([]int, error) {
+	if u.session == nil {
+		u.session = &Session{}
+	}
+	u.session.ChunkSize = u.chunkSize
+
+	if resume := u.opts.Resume; resume != nil && resume.FileID != "" {
+		pending, err := u.resume(ctx, resume)
+		if err == nil {
+			return pending, nil
+		}
+		if apiErr, ok := err.(*Error); !ok || apiErr.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+		// The server no longer has the upload, start over. Chunks of it may
+		// have been sent with the interrupted upload's key and IV, so the new
+		// upload gets a fresh IV, and a fresh key unless one was given.
+		if u.opts.Encrypt {
+			if err := u.encrypt(u.opts.Key, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	u.session.FileID = uuid.New().String()
+	var resp *chunkResponse
+	err := u.client.withRetries(ctx, func() error {
+		var err error
+		resp, err = u.sendChunk(ctx, 0, "")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u.session.ResumeToken = resp.ResumeToken
+	u.addTokens(1, resp.InitialChunkTokens)
+	u.reportProgress(u.chunkLength(0))
+	if u.opts.OnSession != nil {
+		u.opts.OnSession(u.session)
+	}
+
+	pending := make([]int, 0, u.totalChunks-1)
+	for i := 1; i < u.totalChunks; i++ {
+		pending = append(pending, i)
+	}
+	return pending, nil
+}
+
+// resume asks the server which chunks of an interrupted upload are missing
+func (u *upload) resume(ctx context.Context, resume *Session) ([]int, error) {
+	req, err := u.client.newRequest(ctx, http.MethodGet, "/upload/"+url.PathEscape(resume.FileID)+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Resume-Token", resume.ResumeToken)
+
+	var status statusResponse
+	if err := u.client.doJSON(req, &status); err != nil {
+		return nil, err
+	}
+	if status.TotalChunks != u.totalChunks || status.FileSize != u.size {
+		return nil, fmt.Errorf("%w: upload %s has a different size", ErrResumeMismatch, resume.FileID)
+	}
+
+	missing := map[int]bool{}
+	for _, index := range status.MissingChunks {
+		missing[index] = true
+	}
+	if missing[0] {
+		// Without chunk 0 the server has no upload metadata
+		return nil, &Error{StatusCode: http.StatusNotFound, Message: "upload has not started"}
+	}
+
+	// The chunks already on the server must be the ones this file would send,
+	// otherwise the upload would mix two files, and an encrypted upload would
+	// reuse its key and IV for different content
+	for i := 0; i < u.totalChunks; i++ {
+		if missing[i] {
+			continue
+		}
+		hash, err := u.chunkHash(i)
+		if err != nil {
+			return nil, err
+		}
+		if status.ChunkHashes[strconv.Itoa(i)] != hash {
+			return nil, fmt.Errorf("%w: chunk %d of upload %s has different content", ErrResumeMismatch, i, resume.FileID)
+		}
+	}
+
+	u.session.FileID = resume.FileID
+	u.session.ResumeToken = resume.ResumeToken
+	for key, token := range status.ChunkTokens {
+		if index, err := strconv.Atoi(key); err == nil {
+			u.tokens[index] = token
+		}
+	}
+	u.tokens[u.totalChunks] = status.FinalizeToken
+
+	var uploaded int64
+	for i := 0; i < u.totalChunks; i++ {
+		if !missing[i] {
+			uploaded += u.chunkLength(i)
+		}
+	}
+	u.reportProgress(uploaded)
+	if u.opts.OnSession != nil {
+		u.opts.OnSession(u.session)
+	}
+	return status.MissingChunks, nil
+}
+
+// chunkResult is the outcome of uploading one chunk
+type chunkResult struct {
+	index  int
+	tokens []string
+	err    error
+}
+
+// uploadChunks uploads the pending chunks in order, several at a time. A
+// chunk is only sent once the server has issued its token, which arrives
+// with the response for one of the three chunks before it.
+func (u *upload) uploadChunks(ctx context.Context, pending []int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := u.client.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > TokenWindow {
+		concurrency = TokenWindow
+	}
+
+	results := make(chan chunkResult, concurrency)
+	uploaded := u.size - u.pendingLength(pending)
+	next, inFlight := 0, 0
+	for next < len(pending) || inFlight > 0 {
+		for next < len(pending) && inFlight < concurrency {
+			index := pending[next]
+			token, ok := u.tokens[index]
+			if !ok {
+				break
+			}
+			next++
+			inFlight++
+			go func() {
+				var resp *chunkResponse
+				err := u.client.withRetries(ctx, func() error {
+					var err error
+					resp, err = u.sendChunk(ctx, index, token)
+					return err
+				})
+				result := chunkResult{index: index, err: err}
+				if resp != nil {
+					result.tokens = resp.NextChunkTokens
+				}
+				results <- result
+			}()
+		}
+		if inFlight == 0 {
+			return fmt.Errorf("server issued no token for chunk %d", pending[next])
+		}
+
+		result := <-results
+		inFlight--
+		if result.err != nil {
+			// Stop the other chunks; results is buffered so they can finish
+			return fmt.Errorf("failed to upload chunk %d: %w", result.index, result.err)
+		}
+		u.addTokens(result.index+1, result.tokens)
+		uploaded += u.chunkLength(result.index)
+		u.reportProgress(uploaded)
+	}
+	return nil
+}
+
+// sendChunk uploads a single chunk. Chunk 0 carries the upload metadata.
+func (u *upload) sendChunk(ctx context.Context, index int, token string) (*chunkResponse, error) {
+	data, err := u.readChunk(index)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+
+	fields := map[string]string{
+		"file_id":      u.session.FileID,
+		"chunk_index":  strconv.Itoa(index),
+		"total_chunks": strconv.Itoa(u.totalChunks),
+		"file_size":    strconv.FormatInt(u.size, 10),
+		"chunk_hash":   hex.EncodeToString(hash[:]),
+	}
+	if index == 0 {
+		u.addMetadata(fields)
+	}
+
+	req, err := u.newFormRequest(ctx, "/upload/chunk", fields, data)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Chunk-Token", token)
+	}
+
+	var resp chunkResponse
+	if err := u.client.doJSON(req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// uploadEmpty uploads an empty file, which the server finalizes without
+// chunk tokens
+func (u *upload) uploadEmpty(ctx context.Context) (*UploadResult, error) {
+	u.session = &Session{FileID: uuid.New().String()}
+	fields := map[string]string{
+		"file_id":      u.session.FileID,
+		"chunk_index":  "0",
+		"total_chunks": "0",
+		"file_size":    "0",
+	}
+	u.addMetadata(fields)
+
+	err := u.client.withRetries(ctx, func() error {
+		req, err := u.newFormRequest(ctx, "/upload/chunk", fields, nil)
+		if err != nil {
+			return err
+		}
+		return u.client.doJSON(req, &chunkResponse{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.finalize(ctx)
+}
+
+// finalize asks the server to assemble the uploaded chunks into the file
+func (u *upload) finalize(ctx context.Context) (*UploadResult, error) {
+	fields := map[string]string{
+		"file_id":      u.session.FileID,
+		"total_chunks": strconv.Itoa(u.totalChunks),
+	}
+
+	var resp chunkResponse
+	err := u.client.withRetries(ctx, func() error {
+		req, err := u.newFormRequest(ctx, "/upload/finalize", fields, nil)
+		if err != nil {
+			return err
+		}
+		if token := u.tokens[u.totalChunks]; token != "" {
+			req.Header.Set("X-Chunk-Token", token)
+		}
+		return u.client.doJSON(req, &resp)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize upload: %w", err)
+	}
+
+	result := &UploadResult{
+		FileID:      resp.FileID,
+		URL:         u.client.fileURL(resp.FileID, resp.RedirectURL),
+		DeleteToken: resp.DeleteToken,
+		Key:         u.session.Key,
+	}
+	if u.opts.Encrypt {
+		result.URL += "#" + u.session.Key
+	}
+	return result, nil
+}
+
+// addMetadata adds the upload options sent with the first chunk
+func (u *upload) addMetadata(fields map[string]string) {
+	fields["filename"] = u.opts.Filename
+	if u.opts.Expiry != "" {
+		fields["expiry"] = u.opts.Expiry
+	}
+	if u.opts.MaxDownloads > 0 {
+		fields["max_downloads"] = strconv.Itoa(u.opts.MaxDownloads)
+	}
+	if u.opts.Encrypt {
+		fields["encrypted"] = "true"
+		if len(u.sample) > 0 {
+			fields["encrypted_sample"] = base64.StdEncoding.EncodeToString(u.sample)
+		}
+	}
+}
+
+// newFormRequest builds a multipart request with the given fields and, if
+// data is not nil, the chunk as the "file" part
+func (u *upload) newFormRequest(ctx context.Context, path string, fields map[string]string, data []byte) (*http.Request, error) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if data != nil {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(u.opts.Filename)))
+		header.Set("Content-Type", u.contentType)
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := u.client.newRequest(ctx, http.MethodPost, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if err := u.client.addCSRF(ctx, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// addTokens records the tokens issued for the chunks starting at first
+func (u *upload) addTokens(first int, tokens []string) {
+	for i, token := range tokens {
+		u.tokens[first+i] = token
+	}
+}
+
+// chunkLength returns the size of a chunk; the last one may be short
+func (u *upload) chunkLength(index int) int64 {
+	start := int64(index) * u.chunkSize
+	return min(u.chunkSize, u.size-start)
+}
+
+// readChunk reads a chunk's content from the source
+func (u *upload) readChunk(index int) ([]byte, error) {
+	data := make([]byte, u.chunkLength(index))
+	if _, err := u.src.ReadAt(data, int64(index)*u.chunkSize); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+	return data, nil
+}
+
+// chunkHash returns the hex SHA-256 hash of a chunk's content
+func (u *upload) chunkHash(index int) (string, error) {
+	data, err := u.readChunk(index)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// pendingLength returns the total size of the given chunks
+func (u *upload) pendingLength(pending []int) int64 {
+	var total int64
+	for _, index := range pending {
+		total += u.chunkLength(index)
+	}
+	return total
+}
+
+func (u *upload) reportProgress(uploaded int64) {
+	if u.opts.Progress != nil {
+		u.opts.Progress(uploaded, u.size)
+	}
+}
+
+// doJSON sends a request and decodes a successful JSON response into out
+func (c *Client) doJSON(req *http.Request, out interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from server: %w", err)
+	}
+	return nil
+}
+
+// fileURL returns the share URL for a file. The server's redirect URL is
+// preferred as it uses the server's public address.
+func (c *Client) fileURL(fileID, redirectURL string) string {
+	if u, err := url.Parse(redirectURL); err == nil && u.Host != "" {
+		u.RawQuery = ""
+		return u.String()
+	}
+	return c.BaseURL + "/file/" + url.PathEscape(fileID)
+}
+
+// detectContentType picks the content type sent with the upload
+func detectContentType(contentType, filename string, head []byte) string {
+	if contentType != "" {
+		return contentType
+	}
+	if byExt := mime.TypeByExtension(filepath.Ext(filename)); byExt != "" {
+		return byExt
+	}
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	return http.DetectContentType(head)
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
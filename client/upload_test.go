@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeServer implements the chunked upload protocol, issuing each chunk's
+// token in the responses for the chunks before it as the server does
+type fakeServer struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	fileID      string
+	totalChunks int
+	chunks      map[int][]byte
+	issued      map[int]bool // Chunks whose token has been sent
+	content     []byte       // The assembled upload, once finalized
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *httptest.Server) {
+	f := &fakeServer{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", f.uploadPage)
+	mux.HandleFunc("GET /upload/{id}/status", http.NotFound)
+	mux.HandleFunc("POST /upload/chunk", f.chunk)
+	mux.HandleFunc("POST /upload/finalize", f.finalize)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeServer) uploadPage(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "csrf_token", Value: "cookie-token"})
+	fmt.Fprint(w, `<form><input type="hidden" name="csrf_token" value="form-token"></form>`)
+}
+
+// tokens issues the tokens for chunks first to last, the last being the
+// finalize token
+func (f *fakeServer) tokens(first, last int) []string {
+	var tokens []string
+	for i := first; i <= min(last, f.totalChunks); i++ {
+		f.issued[i] = true
+		tokens = append(tokens, "token-"+strconv.Itoa(i))
+	}
+	return tokens
+}
+
+func (f *fakeServer) chunk(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-CSRF-Token") != "form-token" {
+		http.Error(w, "missing CSRF token", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	index, _ := strconv.Atoi(r.FormValue("chunk_index"))
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(file)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := map[string]interface{}{"status": "success"}
+	if index == 0 {
+		f.fileID = r.FormValue("file_id")
+		f.totalChunks, _ = strconv.Atoi(r.FormValue("total_chunks"))
+		f.chunks = map[int][]byte{}
+		f.issued = map[int]bool{}
+		resp["resume_token"] = "resume-token"
+		resp["initial_chunk_tokens"] = f.tokens(1, TokenWindow)
+	} else {
+		if r.FormValue("file_id") != f.fileID || !f.issued[index] || r.Header.Get("X-Chunk-Token") != "token-"+strconv.Itoa(index) {
+			f.t.Errorf("chunk %d sent without its token", index)
+			http.Error(w, "invalid chunk token", http.StatusForbidden)
+			return
+		}
+		resp["next_chunk_tokens"] = f.tokens(index+1, index+TokenWindow)
+	}
+	f.chunks[index] = data
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *fakeServer) finalize(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.issued[f.totalChunks] || r.Header.Get("X-Chunk-Token") != "token-"+strconv.Itoa(f.totalChunks) {
+		http.Error(w, "invalid finalize token", http.StatusForbidden)
+		return
+	}
+	var content []byte
+	for i := 0; i < f.totalChunks; i++ {
+		chunk, ok := f.chunks[i]
+		if !ok {
+			http.Error(w, fmt.Sprintf("chunk %d is missing", i), http.StatusBadRequest)
+			return
+		}
+		content = append(content, chunk...)
+	}
+	f.content = content
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "file_id": f.fileID, "delete_token": "delete-token"})
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	c.ChunkSize = 1000
+	c.MaxRetries = 0
+	return c
+}
+
+func TestUploadChunkTokenWindow(t *testing.T) {
+	f, server := newFakeServer(t)
+	c := newTestClient(t, server)
+
+	content := make([]byte, 10500) // 11 chunks, the last one short
+	rand.New(rand.NewSource(1)).Read(content)
+	var uploaded int64
+	result, err := c.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), UploadOptions{
+		Filename: "window.bin",
+		Progress: func(done, total int64) { uploaded = done },
+	})
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	if result.FileID != f.fileID || result.DeleteToken != "delete-token" {
+		t.Errorf("got result %+v for upload %s", result, f.fileID)
+	}
+	if !bytes.Equal(f.content, content) {
+		t.Errorf("the server assembled different content")
+	}
+	if uploaded != int64(len(content)) {
+		t.Errorf("progress ended at %d bytes, want %d", uploaded, len(content))
+	}
+}
+
+func TestResumeFallbackEncryptsWithFreshIV(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("resumed "), 500)
+	oldKey, _ := GenerateKey()
+	oldIV := []byte("reused nonce")
+	resume := &Session{FileID: "gone", ResumeToken: "resume-token", ChunkSize: 1000, Key: oldKey, IV: oldIV}
+
+	for _, tc := range []struct {
+		name string
+		key  string // Key given by the caller
+	}{
+		{"generated key", ""},
+		{"given key", oldKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, server := newFakeServer(t)
+			c := newTestClient(t, server)
+			var session *Session
+			result, err := c.Upload(context.Background(), bytes.NewReader(plaintext), int64(len(plaintext)), UploadOptions{
+				Encrypt:   true,
+				Key:       tc.key,
+				Resume:    resume,
+				OnSession: func(s *Session) { session = s },
+			})
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+
+			uploaded := f.content
+			if bytes.Equal(uploaded[:IVSize], oldIV) || bytes.Equal(session.IV, oldIV) {
+				t.Errorf("the new upload reused the interrupted upload's IV")
+			}
+			if tc.key == "" && result.Key == oldKey {
+				t.Errorf("the new upload reused the interrupted upload's key")
+			}
+			if tc.key != "" && result.Key != tc.key {
+				t.Errorf("got key %q, want the given key %q", result.Key, tc.key)
+			}
+			if session.Key != result.Key || !bytes.Equal(session.IV, uploaded[:IVSize]) {
+				t.Errorf("the saved session does not match the upload")
+			}
+			decrypted, err := Decrypt(uploaded, result.Key)
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("the upload does not decrypt with its key: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"uploadfish/client"
+)
+
+// runGet downloads a file, decrypting it if the URL has a key
+func runGet(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("uploadfish-cli get", flag.ContinueOnError)
+	var cf clientFlags
+	cf.register(flags)
+	output := flags.String("o", "", "Output file, or - for standard output (default the file's name)")
+	key := flags.String("key", "", "Encryption key, if it is not in the URL")
+	quiet := flags.Bool("q", false, "Don't show a progress bar")
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	c, err := cf.newClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fileID, urlKey, err := client.ParseFileURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *key == "" {
+		*key = urlKey
+	}
+
+	info, err := c.Info(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if info.IsEncrypted && *key == "" {
+		return client.ErrKeyRequired
+	}
+
+	path := *output
+	if path == "" {
+		// Only the base name, so a stored name can't write elsewhere
+		path = filepath.Base(info.Filename)
+		if path == "." || path == string(filepath.Separator) {
+			path = fileID
+		}
+	}
+
+	out := os.Stdout
+	if path != "-" {
+		// Don't overwrite a file by accident
+		out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	bar := newProgressBar("Downloading", *quiet)
+	writer := &progressWriter{w: out, bar: bar, total: info.Size}
+	if info.IsEncrypted {
+		// Progress counts the decrypted bytes written
+		writer.total = info.Size - client.IVSize - client.TagSize
+	}
+	_, err = c.DownloadWithKey(ctx, fileID, *key, writer)
+	bar.Finish()
+	if err != nil {
+		if path != "-" {
+			out.Close()
+			os.Remove(path)
+		}
+		return err
+	}
+
+	if path != "-" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Saved %s (%s)\n", path, formatBytes(writer.written))
+	}
+	return nil
+}
+
+// runInfo prints a file's details
+func runInfo(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("uploadfish-cli info", flag.ContinueOnError)
+	var cf clientFlags
+	cf.register(flags)
+	if err := parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	c, err := cf.newClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fileID, _, err := client.ParseFileURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	info, err := c.Info(ctx, fileID)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", info.ID)
+	fmt.Fprintf(tw, "Filename:\t%s\n", info.Filename)
+	fmt.Fprintf(tw, "Type:\t%s\n", info.MimeType)
+	fmt.Fprintf(tw, "Size:\t%s (%d bytes)\n", formatBytes(info.Size), info.Size)
+	fmt.Fprintf(tw, "Uploaded:\t%s\n", info.UploadTime.Local().Format(time.RFC1123))
+	if info.ExpiresAt != nil {
+		fmt.Fprintf(tw, "Expires:\t%s\n", info.ExpiresAt.Local().Format(time.RFC1123))
+	} else {
+		fmt.Fprintf(tw, "Expires:\t%s\n", info.Expiry)
+	}
+	fmt.Fprintf(tw, "Encrypted:\t%t\n", info.IsEncrypted)
+	if info.MaxDownloads > 0 && info.DownloadsRemaining != nil {
+		fmt.Fprintf(tw, "Downloads left:\t%d of %d\n", *info.DownloadsRemaining, info.MaxDownloads)
+	}
+	fmt.Fprintf(tw, "URL:\t%s\n", info.URL)
+	return tw.Flush()
+}
+
+// runRm deletes a file with its delete token
+func runRm(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("uploadfish-cli rm", flag.ContinueOnError)
+	var cf clientFlags
+	cf.register(flags)
+	if err := parseFlags(flags, args, 2); err != nil {
+		return err
+	}
+
+	c, err := cf.newClient(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fileID, _, err := client.ParseFileURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := c.Delete(ctx, fileID, flags.Arg(1)); err != nil {
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("the delete token is not valid for this file")
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %s\n", fileID)
+	return nil
+}
@@ -0,0 +1,116 @@
+// Command uploadfish-cli uploads files to and downloads files from an UploadFish
+// server from the command line.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"uploadfish/client"
+)
+
+const usage = `Usage:
+  uploadfish-cli put [flags] [FILE]    Upload a file, or standard input if FILE is omitted or "-"
+  uploadfish-cli get [flags] URL       Download a file, decrypting it with the key in the URL
+  uploadfish-cli info [flags] URL      Show a file's details
+  uploadfish-cli rm [flags] URL TOKEN  Delete a file with its delete token
+
+The server is set with -server or UPLOADFISH_URL, and an API key with
+-api-key or UPLOADFISH_API_KEY. Run "uploadfish-cli COMMAND -h" for a command's
+flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "put":
+		err = runPut(ctx, os.Args[2:])
+	case "get":
+		err = runGet(ctx, os.Args[2:])
+	case "info":
+		err = runInfo(ctx, os.Args[2:])
+	case "rm":
+		err = runRm(ctx, os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// errUsage is returned for invalid command lines, after the flag package
+// has printed the problem and the command's usage
+var errUsage = errors.New("invalid usage")
+
+// parseFlags parses a command's flags, requiring nargs positional arguments
+// (or up to -nargs if negative)
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	flags.SetOutput(os.Stderr)
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	if (nargs >= 0 && flags.NArg() != nargs) || (nargs < 0 && flags.NArg() > -nargs) {
+		flags.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// clientFlags are the flags shared by every command
+type clientFlags struct {
+	server string
+	apiKey string
+}
+
+func (f *clientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.server, "server", os.Getenv("UPLOADFISH_URL"), "Server URL (default $UPLOADFISH_URL)")
+	flags.StringVar(&f.apiKey, "api-key", "", "API key (default $UPLOADFISH_API_KEY)")
+}
+
+// newClient creates a client for the configured server. fileURL is the file
+// a command works on, whose server is used if none is configured.
+func (f *clientFlags) newClient(fileURL string) (*client.Client, error) {
+	server := f.server
+	if server == "" && fileURL != "" {
+		if u, err := url.Parse(fileURL); err == nil && u.Host != "" {
+			server = u.Scheme + "://" + u.Host
+		}
+	}
+	if server == "" {
+		return nil, fmt.Errorf("no server set, use -server or UPLOADFISH_URL")
+	}
+
+	c, err := client.New(server)
+	if err != nil {
+		return nil, err
+	}
+	c.APIKey = f.apiKey
+	if c.APIKey == "" {
+		c.APIKey = os.Getenv("UPLOADFISH_API_KEY")
+	}
+	return c, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBar draws a progress bar on standard error. It draws nothing when
+// standard error is not a terminal, so logs of scripted runs stay clean.
+type progressBar struct {
+	label   string
+	enabled bool
+	started time.Time
+
+	mu       sync.Mutex
+	current  int64
+	total    int64
+	lastDraw time.Time
+}
+
+func newProgressBar(label string, quiet bool) *progressBar {
+	return &progressBar{
+		label:   label,
+		enabled: !quiet && isTerminal(os.Stderr),
+		started: time.Now(),
+	}
+}
+
+// Update sets the progress, redrawing at most a few times a second
+func (p *progressBar) Update(current, total int64) {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current, p.total = current, total
+	if time.Since(p.lastDraw) < 100*time.Millisecond && current < total {
+		return
+	}
+	p.lastDraw = time.Now()
+	p.draw()
+}
+
+// Finish draws the final state and ends the line
+func (p *progressBar) Finish() {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressBar) draw() {
+	const width = 30
+
+	elapsed := time.Since(p.started).Seconds()
+	rate := ""
+	if elapsed > 0 {
+		rate = formatBytes(int64(float64(p.current)/elapsed)) + "/s"
+	}
+
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%s %s %s\033[K", p.label, formatBytes(p.current), rate)
+		return
+	}
+
+	done := int(float64(width) * float64(p.current) / float64(p.total))
+	if done > width {
+		done = width
+	}
+	bar := strings.Repeat("=", done) + strings.Repeat(" ", width-done)
+	percent := 100 * float64(p.current) / float64(p.total)
+	fmt.Fprintf(os.Stderr, "\r%s [%s] %3.0f%% %s / %s %s\033[K",
+		p.label, bar, percent, formatBytes(p.current), formatBytes(p.total), rate)
+}
+
+// progressWriter counts the bytes written through it into a progress bar
+type progressWriter struct {
+	w       io.Writer
+	bar     *progressBar
+	written int64
+	total   int64
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.written += int64(n)
+	pw.bar.Update(pw.written, pw.total)
+	return n, err
+}
+
+// formatBytes formats a byte count for display
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
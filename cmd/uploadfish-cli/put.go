@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"uploadfish/client"
+)
+
+// runPut uploads a file or standard input and prints its URL
+func runPut(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("uploadfish-cli put", flag.ContinueOnError)
+	var cf clientFlags
+	cf.register(flags)
+	expiry := flags.String("expiry", "", "How long to keep the file, e.g. 24h or when_downloaded (default the server's default)")
+	maxDownloads := flags.Int("max-downloads", 0, "Delete the file after this many downloads (0 for unlimited)")
+	encrypt := flags.Bool("encrypt", false, "Encrypt the file before uploading; the key is added to the URL")
+	name := flags.String("name", "", "Filename to store (default the file's name, or \"stdin\")")
+	contentType := flags.String("type", "", "Content type (default detected from the name or content)")
+	chunkSize := flags.Int64("chunk-size", client.DefaultChunkSize, "Chunk size in bytes")
+	noResume := flags.Bool("no-resume", false, "Start over instead of resuming an interrupted upload of the same file")
+	quiet := flags.Bool("q", false, "Don't show a progress bar")
+	if err := parseFlags(flags, args, -1); err != nil {
+		return err
+	}
+
+	c, err := cf.newClient("")
+	if err != nil {
+		return err
+	}
+	c.ChunkSize = *chunkSize
+
+	opts := client.UploadOptions{
+		Filename:     *name,
+		ContentType:  *contentType,
+		Expiry:       *expiry,
+		MaxDownloads: *maxDownloads,
+		Encrypt:      *encrypt,
+	}
+
+	path := flags.Arg(0)
+	resumable := path != "" && path != "-"
+	if path == "" || path == "-" {
+		// The protocol needs the size up front and chunks may be retried, so
+		// standard input is spooled to a temporary file first
+		spooled, err := spoolStdin()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spooled)
+		path = spooled
+		if opts.Filename == "" {
+			opts.Filename = "stdin"
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	// Interrupted uploads of the same file with the same options are resumed
+	var statePath string
+	if resumable {
+		statePath, err = resumeStatePath(c.BaseURL, path, info, opts)
+		if err != nil {
+			return err
+		}
+		if session, err := loadResumeState(statePath); err == nil && !*noResume {
+			fmt.Fprintln(os.Stderr, "Resuming interrupted upload")
+			opts.Resume = session
+		}
+		opts.OnSession = func(session *client.Session) {
+			if err := saveResumeState(statePath, session); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: upload can't be resumed: %v\n", err)
+			}
+		}
+	}
+
+	bar := newProgressBar("Uploading", *quiet)
+	opts.Progress = bar.Update
+	result, err := c.UploadFile(ctx, path, opts)
+	bar.Finish()
+	if err != nil {
+		if errors.Is(err, client.ErrResumeMismatch) {
+			// Resuming can never succeed, so the next run starts over
+			os.Remove(statePath)
+			fmt.Fprintln(os.Stderr, "Run the same command again to start the upload over.")
+		} else if statePath != "" {
+			if _, statErr := os.Stat(statePath); statErr == nil {
+				fmt.Fprintln(os.Stderr, "Run the same command again to resume the upload.")
+			}
+		}
+		return err
+	}
+	if statePath != "" {
+		os.Remove(statePath)
+	}
+
+	fmt.Println(result.URL)
+	fmt.Fprintf(os.Stderr, "Delete token: %s\n", result.DeleteToken)
+	return nil
+}
+
+// spoolStdin copies standard input to a temporary file
+func spoolStdin() (string, error) {
+	f, err := os.CreateTemp("", "uploadfish-stdin-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to read standard input: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// resumeStatePath returns where the resume state of an upload is kept. The
+// name identifies the server, the file as it is now and the upload options,
+// so a changed file or different options start a new upload.
+func resumeStatePath(server, path string, info os.FileInfo, opts client.UploadOptions) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%d\n%d\n%s\n%s\n%s\n%d\n%t",
+		server, absPath, info.Size(), info.ModTime().UnixNano(),
+		opts.Filename, opts.ContentType, opts.Expiry, opts.MaxDownloads, opts.Encrypt)
+	return filepath.Join(cacheDir, "uploadfish", "uploads", hex.EncodeToString(hash.Sum(nil))+".json"), nil
+}
+
+func loadResumeState(path string) (*client.Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	session := &client.Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// saveResumeState records an upload session. It may hold the encryption key,
+// so it is only readable by the user.
+func saveResumeState(path string, session *client.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
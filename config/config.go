@@ -1,83 +1,468 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"uploadfish/models"
 )
 
-// Config holds the application configuration
+// Config holds the application configuration. Each field is read from the
+// environment variable named in its env tag, or from the same name in lower
+// case in a config file. The "size" option accepts units such as "1GB", and
+// "secret" values are masked when the configuration is printed.
 type Config struct {
-	Port             string
-	BaseURL          string
-	MaxUploadSize    int64
-	AllowedTypes     []string
-	BitcaskPath      string
-	CleanupInterval  time.Duration
-	RateLimit        int
-	RateLimitWindow  time.Duration
-	RateLimitCleanup time.Duration
-	CSRFExpiration   time.Duration
+	Port                string        `env:"PORT"`
+	BaseURL             string        `env:"BASE_URL"`
+	MaxUploadSize       int64         `env:"MAX_UPLOAD_SIZE,size"`
+	AllowedTypes        []string      `env:"ALLOWED_TYPES"`
+	BitcaskPath         string        `env:"BITCASK_PATH"`
+	ChunkPath           string        `env:"CHUNK_PATH"`
+	StorageBackend      string        `env:"STORAGE_BACKEND"`
+	ContentPath         string        `env:"CONTENT_PATH"`
+	S3Endpoint          string        `env:"S3_ENDPOINT"`
+	S3Bucket            string        `env:"S3_BUCKET"`
+	S3AccessKey         string        `env:"S3_ACCESS_KEY"`
+	S3SecretKey         string        `env:"S3_SECRET_KEY,secret"`
+	S3Region            string        `env:"S3_REGION"`
+	S3UseSSL            bool          `env:"S3_USE_SSL"`
+	S3Prefix            string        `env:"S3_PREFIX"`
+	Compression         string        `env:"COMPRESSION"`
+	CompressionMaxRatio float64       `env:"COMPRESSION_MAX_RATIO"`
+	CompressionCodec    string        `env:"COMPRESSION_CODEC"`
+	ZstdLevel           int           `env:"ZSTD_LEVEL"`
+	MaxDownloadsLimit   int           `env:"MAX_DOWNLOADS_LIMIT"`
+	ExpiryOptions       []string      `env:"EXPIRY_OPTIONS"`
+	DefaultExpiry       string        `env:"DEFAULT_EXPIRY"`
+	MaxRetention        time.Duration `env:"MAX_RETENTION"`
+	CleanupInterval     time.Duration `env:"CLEANUP_INTERVAL"`
+	RateLimit           int           `env:"RATE_LIMIT"`
+	RateLimitWindow     time.Duration `env:"RATE_LIMIT_WINDOW"`
+	RateLimitCleanup    time.Duration `env:"RATE_LIMIT_CLEANUP"`
+	APIKeyRateLimit     int           `env:"API_KEY_RATE_LIMIT"`
+	CSRFExpiration      time.Duration `env:"CSRF_EXPIRATION"`
+	MetricsEnabled      bool          `env:"METRICS_ENABLED"`
+	TracingEnabled      bool          `env:"TRACING_ENABLED"`
+	MinFreeDiskSpace    int64         `env:"MIN_FREE_DISK_SPACE,size"`
+	DrainTimeout        time.Duration `env:"DRAIN_TIMEOUT"`
+
+	// sources records where each setting came from, by environment variable
+	sources map[string]string
+}
+
+// Where a setting's value came from
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+)
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Port:                "8085",
+		BaseURL:             "",
+		MaxUploadSize:       1073741824, // 1GB default (1024MB)
+		AllowedTypes:        []string{"*"},
+		BitcaskPath:         "data",
+		ChunkPath:           "",        // Defaults to "chunks" inside BitcaskPath so sessions and chunks persist together
+		StorageBackend:      "bitcask", // Where file content is stored
+		ContentPath:         "content", // Root directory for the filesystem backend
+		S3Endpoint:          "",        // host:port of the S3-compatible service
+		S3Bucket:            "uploadfish",
+		S3AccessKey:         "",
+		S3SecretKey:         "",
+		S3Region:            "",
+		S3UseSSL:            true,
+		S3Prefix:            "",                                 // Optional key prefix inside the bucket
+		Compression:         "auto",                             // auto, always or never
+		CompressionMaxRatio: 0.9,                                // Store raw if a trial compresses worse than this
+		CompressionCodec:    "gzip",                             // gzip or zstd
+		ZstdLevel:           3,                                  // Standard zstd level, 1 (fastest) to 22 (smallest)
+		MaxDownloadsLimit:   100,                                // Highest download limit an upload may request
+		ExpiryOptions:       []string{"1h", "6h", "24h", "72h"}, // Go durations or whole days, e.g. "7d"
+		DefaultExpiry:       "1h",                               // Must be one of the expiry options
+		MaxRetention:        0,                                  // Longest a file may be kept, 0 for no limit
+		CleanupInterval:     1 * time.Minute,
+		RateLimit:           60,               // 60 requests per window
+		RateLimitWindow:     1 * time.Minute,  // 1 minute window
+		RateLimitCleanup:    5 * time.Minute,  // Clean up every 5 minutes
+		APIKeyRateLimit:     600,              // Requests per window for each API key
+		CSRFExpiration:      12 * time.Hour,   // CSRF tokens expire after 12 hours (increased)
+		MetricsEnabled:      true,             // Serve Prometheus metrics on /metrics
+		TracingEnabled:      false,            // Export OpenTelemetry traces over OTLP
+		MinFreeDiskSpace:    268435456,        // /readyz fails below this many free bytes, 0 to disable
+		DrainTimeout:        10 * time.Minute, // Time given to uploads in progress at shutdown
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML or TOML file at
+// path if one is given, then environment variables, which override the file.
+// Any malformed value or invalid combination of settings is an error, and all
+// problems are reported together.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	cfg.sources = make(map[string]string)
+
+	var fileErr error
+	if path != "" {
+		fileErr = cfg.loadFile(path)
+	}
+	envErr := cfg.loadEnv()
+	if cfg.ChunkPath == "" {
+		cfg.ChunkPath = filepath.Join(cfg.BitcaskPath, "chunks")
+	}
+
+	// Settings that failed to parse keep their defaults, so validating the
+	// rest still reports every problem at once
+	if err := errors.Join(fileErr, envErr, cfg.Validate()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads settings from a YAML (.yaml, .yml) or TOML (.toml) file
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	fields := make(map[string]field)
+	for _, f := range c.fields() {
+		fields[f.key()] = f
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		value := values[key]
+		f, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+			continue
+		}
+		s, err := fileValueString(value)
+		if err == nil {
+			err = f.set(s)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+			continue
+		}
+		c.sources[f.env] = SourceFile
+	}
+	return errors.Join(errs...)
+}
+
+// fileValueString converts a value decoded from a config file to the form it
+// would take in an environment variable, so both are parsed the same way
+func fileValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := fileValueString(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q must not contain a comma", s)
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// loadEnv reads settings from environment variables. Empty variables are
+// treated as unset.
+func (c *Config) loadEnv() error {
+	var errs []error
+	for _, f := range c.fields() {
+		value := os.Getenv(f.env)
+		if value == "" {
+			continue
+		}
+		if err := f.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			continue
+		}
+		c.sources[f.env] = SourceEnv
+	}
+	return errors.Join(errs...)
 }
 
-// New creates a new configuration with defaults and environment overrides
-func New() *Config {
-	// Default configuration
-	cfg := &Config{
-		Port:             getEnv("PORT", "8085"),
-		BaseURL:          getEnv("BASE_URL", ""),
-		MaxUploadSize:    getEnvAsInt64("MAX_UPLOAD_SIZE", 1073741824), // 1GB default (1024MB)
-		AllowedTypes:     getEnvAsStringSlice("ALLOWED_TYPES", "*"),
-		BitcaskPath:      getEnv("BITCASK_PATH", "data"),
-		CleanupInterval:  getEnvAsDuration("CLEANUP_INTERVAL", 1*time.Minute),
-		RateLimit:        getEnvAsInt("RATE_LIMIT", 60),                         // 60 requests per window
-		RateLimitWindow:  getEnvAsDuration("RATE_LIMIT_WINDOW", 1*time.Minute),  // 1 minute window
-		RateLimitCleanup: getEnvAsDuration("RATE_LIMIT_CLEANUP", 5*time.Minute), // Clean up every 5 minutes
-		CSRFExpiration:   getEnvAsDuration("CSRF_EXPIRATION", 12*time.Hour),     // CSRF tokens expire after 12 hours (increased)
+// Validate checks for values the server can't run with and impossible
+// combinations of settings
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port >= 1 && port <= 65535, "PORT: must be a port number from 1 to 65535, got %q", c.Port)
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"BASE_URL: must be an absolute http or https URL, got %q", c.BaseURL)
+	}
+
+	// Databases from older versions need a value limit of the largest upload
+	// plus 1MB of headroom
+	check(c.MaxUploadSize > 0, "MAX_UPLOAD_SIZE: must be positive")
+	check(c.MaxUploadSize <= math.MaxInt64-1024*1024, "MAX_UPLOAD_SIZE: is too large")
+	check(len(c.AllowedTypes) > 0, "ALLOWED_TYPES: at least one type is required, use * to allow all")
+	check(c.BitcaskPath != "", "BITCASK_PATH: must not be empty")
+
+	switch c.StorageBackend {
+	case "bitcask":
+	case "filesystem":
+		check(c.ContentPath != "", "CONTENT_PATH: is required by the filesystem storage backend")
+	case "s3":
+		check(c.S3Endpoint != "", "S3_ENDPOINT: is required by the s3 storage backend")
+		check(c.S3Bucket != "", "S3_BUCKET: is required by the s3 storage backend")
+		check((c.S3AccessKey == "") == (c.S3SecretKey == ""), "S3_ACCESS_KEY and S3_SECRET_KEY: must be set together")
+	default:
+		check(false, "STORAGE_BACKEND: must be bitcask, filesystem or s3, got %q", c.StorageBackend)
 	}
 
-	return cfg
+	check(c.Compression == "auto" || c.Compression == "always" || c.Compression == "never",
+		"COMPRESSION: must be auto, always or never, got %q", c.Compression)
+	check(c.CompressionCodec == "gzip" || c.CompressionCodec == "zstd",
+		"COMPRESSION_CODEC: must be gzip or zstd, got %q", c.CompressionCodec)
+	check(c.CompressionMaxRatio > 0, "COMPRESSION_MAX_RATIO: must be positive")
+	check(c.ZstdLevel >= 1 && c.ZstdLevel <= 22, "ZSTD_LEVEL: must be from 1 to 22, got %d", c.ZstdLevel)
+
+	check(c.MaxDownloadsLimit >= 0, "MAX_DOWNLOADS_LIMIT: must not be negative")
+	if _, err := models.NewExpiryPolicy(c.ExpiryOptions, c.DefaultExpiry, c.MaxRetention); err != nil {
+		errs = append(errs, fmt.Errorf("EXPIRY_OPTIONS, DEFAULT_EXPIRY and MAX_RETENTION: %w", err))
+	}
+	check(c.CleanupInterval > 0, "CLEANUP_INTERVAL: must be positive")
+
+	// Uploads are limited to a tenth of RATE_LIMIT, which must not round to 0
+	check(c.RateLimit >= 10, "RATE_LIMIT: must be at least 10, got %d", c.RateLimit)
+	check(c.RateLimitWindow > 0, "RATE_LIMIT_WINDOW: must be positive")
+	check(c.RateLimitCleanup > 0, "RATE_LIMIT_CLEANUP: must be positive")
+	check(c.APIKeyRateLimit > 0, "API_KEY_RATE_LIMIT: must be positive")
+	check(c.CSRFExpiration > 0, "CSRF_EXPIRATION: must be positive")
+
+	check(c.MinFreeDiskSpace >= 0, "MIN_FREE_DISK_SPACE: must not be negative")
+	check(c.DrainTimeout >= 0, "DRAIN_TIMEOUT: must not be negative")
+
+	return errors.Join(errs...)
+}
+
+// Setting is one entry of the effective configuration
+type Setting struct {
+	Name   string // Environment variable
+	Value  string // Formatted value, masked for secrets
+	Source string // SourceDefault, SourceFile or SourceEnv
 }
 
-// Helper functions for environment variables
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// Settings lists every setting in declaration order with its value and where
+// it came from
+func (c *Config) Settings() []Setting {
+	fields := c.fields()
+	settings := make([]Setting, 0, len(fields))
+	for _, f := range fields {
+		source := c.sources[f.env]
+		if source == "" {
+			source = SourceDefault
+		}
+		value := f.String()
+		if f.secret && value != "" {
+			value = "********"
+		}
+		settings = append(settings, Setting{Name: f.env, Value: value, Source: source})
 	}
-	return defaultValue
+	return settings
+}
+
+// field is a setting's struct field together with its env tag
+type field struct {
+	env    string
+	size   bool
+	secret bool
+	value  reflect.Value
 }
 
-func getEnvAsInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// fields returns the tagged fields of the configuration
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("env")
+		if !ok {
+			continue
 		}
+		name, options, _ := strings.Cut(tag, ",")
+		fields = append(fields, field{
+			env:    name,
+			size:   options == "size",
+			secret: options == "secret",
+			value:  v.Field(i),
+		})
 	}
-	return defaultValue
+	return fields
+}
+
+// key is the name of the setting in a config file
+func (f field) key() string {
+	return strings.ToLower(f.env)
 }
 
-func getEnvAsInt64(key string, defaultValue int64) int64 {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
-			return intValue
+// set parses s into the field
+func (f field) set(s string) error {
+	s = strings.TrimSpace(s)
+	switch p := f.value.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		*p = n
+	case *int64:
+		if f.size {
+			n, err := ParseSize(s)
+			if err != nil {
+				return err
+			}
+			*p = n
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		*p = n
+	case *float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
 		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use a Go duration such as 90s, 30m or 2h", s)
+		}
+		*p = d
+	case *[]string:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*p = items
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
 	}
-	return defaultValue
+	return nil
 }
 
-func getEnvAsStringSlice(key string, defaultValue string) []string {
-	if value := os.Getenv(key); value != "" {
-		return strings.Split(value, ",")
+// String formats the field's value the way it would be written in an
+// environment variable
+func (f field) String() string {
+	switch v := f.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
 	}
-	return []string{defaultValue}
 }
 
-func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
-		if duration, err := time.ParseDuration(value); err == nil {
-			return duration
+// Binary units accepted by ParseSize
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// ParseSize parses a byte count with an optional binary unit, e.g. "1048576",
+// "512MB" or "1.5GB". Units are case-insensitive and multiples of 1024.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	number := strings.TrimRightFunc(s, func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+	})
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[len(number):]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a unit of KB, MB, GB or TB", s)
+	}
+	number = strings.TrimSpace(number)
+
+	if n, err := strconv.ParseInt(number, 10, 64); err == nil {
+		if n != 0 && (n > math.MaxInt64/unit || n < math.MinInt64/unit) {
+			return 0, fmt.Errorf("size %q is too large", s)
 		}
+		return n * unit, nil
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a unit of KB, MB, GB or TB", s)
+	}
+	size := f * float64(unit)
+	if size >= math.MaxInt64 || size <= math.MinInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
 	}
-	return defaultValue
+	return int64(size), nil
 }
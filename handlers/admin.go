@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"uploadfish/models"
+	"uploadfish/storage"
+	"uploadfish/utils"
+)
+
+// Page sizes for GET /api/v1/admin/files
+const (
+	DefaultAdminListLimit = 100
+	MaxAdminListLimit     = 1000
+)
+
+// AdminFileList is a page of files returned by the admin API
+type AdminFileList struct {
+	Files      []FileMetadata `json:"files"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// AdminAPIKey describes an API key in the admin API, without its hash
+type AdminAPIKey struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	CreatedAt     time.Time `json:"created_at"`
+	Admin         bool      `json:"admin"`
+	MaxUploadSize int64     `json:"max_upload_size,omitempty"`
+	ExpiryOptions []string  `json:"expiry_options,omitempty"`
+	DefaultExpiry string    `json:"default_expiry,omitempty"`
+}
+
+// AdminAPIKeyList is returned by GET /api/v1/admin/apikeys
+type AdminAPIKeyList struct {
+	APIKeys []AdminAPIKey `json:"api_keys"`
+}
+
+// CreateAPIKeyRequest is the body of POST /api/v1/admin/apikeys
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name"`
+	Admin         bool     `json:"admin"`
+	MaxUploadSize int64    `json:"max_upload_size"`
+	ExpiryOptions []string `json:"expiry_options"`
+	DefaultExpiry string   `json:"default_expiry"`
+}
+
+// CreateAPIKeyResponse holds a new API key and its secret, which is only
+// ever returned here
+type CreateAPIKeyResponse struct {
+	APIKey AdminAPIKey `json:"api_key"`
+	Key    string      `json:"key"`
+}
+
+// requireAdmin checks that the request was made with an admin API key,
+// writing an error response if not
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	key := utils.APIKeyFromContext(r.Context())
+	if key == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeAPIError(w, http.StatusUnauthorized, APIErrorUnauthorized, "An admin API key is required")
+		return false
+	}
+	if !key.Admin {
+		LogInfo("Admin API request with non-admin key", map[string]interface{}{
+			"key_id": key.ID,
+			"path":   r.URL.Path,
+		})
+		writeAPIError(w, http.StatusForbidden, APIErrorForbidden, "This API key is not an admin key")
+		return false
+	}
+	return true
+}
+
+// APIAdminListFiles handles GET /api/v1/admin/files, listing stored files
+// with optional filters a page at a time
+func (h *Handler) APIAdminListFiles(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	filter, err := parseFileFilter(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, err.Error())
+		return
+	}
+
+	list, err := h.Storage.ListFiles(filter)
+	if err != nil {
+		if err == storage.ErrInvalidCursor {
+			writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, "Invalid cursor")
+			return
+		}
+		LogError(err, "Error listing files for admin API", nil)
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error listing files")
+		return
+	}
+
+	response := AdminFileList{
+		Files:      make([]FileMetadata, 0, len(list.Files)),
+		NextCursor: list.NextCursor,
+	}
+	for _, file := range list.Files {
+		response.Files = append(response.Files, h.newFileMetadata(r, file))
+	}
+	writeAPIJSON(w, http.StatusOK, response)
+}
+
+// parseFileFilter reads a file filter from the query parameters, rejecting
+// malformed or impossible values
+func parseFileFilter(r *http.Request) (storage.FileFilter, error) {
+	query := r.URL.Query()
+	filter := storage.FileFilter{
+		MimePrefix: query.Get("mime_prefix"),
+		ExpiryMode: query.Get("expiry_mode"),
+		Cursor:     query.Get("cursor"),
+		Limit:      DefaultAdminListLimit,
+	}
+
+	var err error
+	if value := query.Get("min_size"); value != "" {
+		if filter.MinSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return filter, errInvalidParam("min_size")
+		}
+	}
+	if value := query.Get("max_size"); value != "" {
+		if filter.MaxSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return filter, errInvalidParam("max_size")
+		}
+	}
+	if value := query.Get("uploaded_after"); value != "" {
+		if filter.UploadedAfter, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, errInvalidParam("uploaded_after")
+		}
+	}
+	if value := query.Get("uploaded_before"); value != "" {
+		if filter.UploadedBefore, err = time.Parse(time.RFC3339, value); err != nil {
+			return filter, errInvalidParam("uploaded_before")
+		}
+	}
+	if value := query.Get("encrypted"); value != "" {
+		encrypted, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, errInvalidParam("encrypted")
+		}
+		filter.Encrypted = &encrypted
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > MaxAdminListLimit {
+			return filter, errInvalidParam("limit")
+		}
+	}
+
+	return filter, filter.Validate()
+}
+
+// errInvalidParam reports a malformed query parameter
+func errInvalidParam(name string) error {
+	return fmt.Errorf("Invalid %s parameter", name)
+}
+
+// newAdminAPIKey builds the admin API description of an API key
+func newAdminAPIKey(key *models.APIKey) AdminAPIKey {
+	return AdminAPIKey{
+		ID:            key.ID,
+		Name:          key.Name,
+		CreatedAt:     key.CreatedAt,
+		Admin:         key.Admin,
+		MaxUploadSize: key.MaxUploadSize,
+		ExpiryOptions: key.ExpiryOptions,
+		DefaultExpiry: key.DefaultExpiry,
+	}
+}
+
+// APIAdminListAPIKeys handles GET /api/v1/admin/apikeys
+func (h *Handler) APIAdminListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	keys, err := h.Storage.ListAPIKeys()
+	if err != nil {
+		LogError(err, "Error listing API keys for admin API", nil)
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error listing API keys")
+		return
+	}
+
+	response := AdminAPIKeyList{APIKeys: make([]AdminAPIKey, 0, len(keys))}
+	for _, key := range keys {
+		response.APIKeys = append(response.APIKeys, newAdminAPIKey(key))
+	}
+	writeAPIJSON(w, http.StatusOK, response)
+}
+
+// APIAdminCreateAPIKey handles POST /api/v1/admin/apikeys, so keys can be
+// issued while the server is running
+func (h *Handler) APIAdminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	var request CreateAPIKeyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, "Invalid JSON body")
+		return
+	}
+
+	key, secret, err := utils.NewAPIKey(request.Name)
+	if err != nil {
+		LogError(err, "Error generating API key", nil)
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error generating API key")
+		return
+	}
+	key.Admin = request.Admin
+	key.MaxUploadSize = request.MaxUploadSize
+	key.ExpiryOptions = request.ExpiryOptions
+	key.DefaultExpiry = request.DefaultExpiry
+	if err := key.Validate(h.Config.MaxUploadSize, h.Expiry.MaxRetention()); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, err.Error())
+		return
+	}
+
+	if err := h.Storage.SaveAPIKey(key); err != nil {
+		LogError(err, "Error saving API key", map[string]interface{}{"api_key_id": key.ID})
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error saving API key")
+		return
+	}
+
+	LogInfo("API key created through admin API", map[string]interface{}{
+		"api_key_id": key.ID,
+		"admin":      key.Admin,
+		"created_by": utils.APIKeyFromContext(r.Context()).ID,
+	})
+	writeAPIJSON(w, http.StatusCreated, CreateAPIKeyResponse{APIKey: newAdminAPIKey(key), Key: secret})
+}
+
+// APIAdminRevokeAPIKey handles DELETE /api/v1/admin/apikeys/{keyID}. The key
+// stops working on the next request made with it.
+func (h *Handler) APIAdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	keyID := chi.URLParam(r, "keyID")
+	if err := h.Storage.DeleteAPIKey(keyID); err != nil {
+		if err == storage.ErrNotFound {
+			writeAPIError(w, http.StatusNotFound, APIErrorNotFound, "API key not found")
+			return
+		}
+		LogError(err, "Error revoking API key", map[string]interface{}{"api_key_id": keyID})
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error revoking API key")
+		return
+	}
+
+	LogInfo("API key revoked through admin API", map[string]interface{}{
+		"api_key_id": keyID,
+		"revoked_by": utils.APIKeyFromContext(r.Context()).ID,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
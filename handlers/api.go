@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"uploadfish/models"
+	"uploadfish/utils"
+)
+
+// APISpecPath is the OpenAPI document describing the /api/v1 endpoints
+const APISpecPath = "static/openapi.json"
+
+// Error codes returned by the /api/v1 endpoints
+const (
+	APIErrorBadRequest       = "bad_request"
+	APIErrorUnauthorized     = "unauthorized"
+	APIErrorNotFound         = "not_found"
+	APIErrorMethodNotAllowed = "method_not_allowed"
+	APIErrorForbidden        = "forbidden"
+	APIErrorGone             = "gone"
+	APIErrorFileTooLarge     = "file_too_large"
+	APIErrorUnsupportedType  = "unsupported_file_type"
+	APIErrorInternal         = "internal_error"
+	APIErrorUnavailable      = "unavailable"
+)
+
+// APIError is the body of every /api/v1 error response
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail describes an API error with a stable machine-readable code
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FileMetadata is the public metadata document for a stored file
+type FileMetadata struct {
+	ID                 string     `json:"id"`
+	Filename           string     `json:"filename"`
+	MimeType           string     `json:"mime_type"`
+	Size               int64      `json:"size"`
+	UploadTime         time.Time  `json:"upload_time"`
+	Expiry             string     `json:"expiry"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+	IsEncrypted        bool       `json:"is_encrypted"`
+	MaxDownloads       int        `json:"max_downloads,omitempty"`
+	DownloadsRemaining *int       `json:"downloads_remaining,omitempty"`
+	URL                string     `json:"url"`
+	DownloadURL        string     `json:"download_url"`
+}
+
+// CreateFileResponse is returned when a file is uploaded through the API
+type CreateFileResponse struct {
+	File        FileMetadata `json:"file"`
+	DeleteToken string       `json:"delete_token"`
+}
+
+// ExpiryOptionsResponse lists the upload options the server accepts
+type ExpiryOptionsResponse struct {
+	Options              []models.ExpiryOption `json:"options"`
+	Default              string                `json:"default"`
+	MaxRetentionSeconds  int64                 `json:"max_retention_seconds,omitempty"`
+	DownloadLimitOptions []models.ExpiryOption `json:"download_limit_options"`
+	MaxDownloadsLimit    int                   `json:"max_downloads_limit"`
+}
+
+// writeAPIJSON writes a JSON response body with the given status
+func writeAPIJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		LogError(err, "Error encoding API response", nil)
+	}
+}
+
+// writeAPIError writes an APIError response
+func writeAPIError(w http.ResponseWriter, statusCode int, code string, message string) {
+	writeAPIJSON(w, statusCode, APIError{Error: APIErrorDetail{Code: code, Message: message}})
+}
+
+// newFileMetadata converts stored metadata to its public API document
+func (h *Handler) newFileMetadata(r *http.Request, file *models.File) FileMetadata {
+	fileURL := fmt.Sprintf("%s/file/%s", h.getBaseURL(r), file.ID)
+	metadata := FileMetadata{
+		ID:           file.ID,
+		Filename:     file.Filename,
+		MimeType:     file.MimeType,
+		Size:         file.Size,
+		UploadTime:   file.UploadTime.UTC(),
+		Expiry:       file.ExpiryValue,
+		IsEncrypted:  file.IsEncrypted,
+		MaxDownloads: file.MaxDownloads,
+		URL:          fileURL,
+		DownloadURL:  fileURL + "?dl=true",
+	}
+	if !file.ExpiryTime.IsZero() {
+		expiresAt := file.ExpiryTime.UTC()
+		metadata.ExpiresAt = &expiresAt
+	}
+	if file.MaxDownloads > 0 {
+		remaining := file.DownloadsRemaining
+		metadata.DownloadsRemaining = &remaining
+	}
+	return metadata
+}
+
+// APINotFound handles unknown /api/v1 routes
+func (h *Handler) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, APIErrorNotFound, "Endpoint not found")
+}
+
+// APIMethodNotAllowed handles unsupported methods on /api/v1 routes
+func (h *Handler) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, APIErrorMethodNotAllowed, "Method not allowed")
+}
+
+// APISpec serves the OpenAPI document for the /api/v1 endpoints
+func (h *Handler) APISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, APISpecPath)
+}
+
+// APIExpiryOptions handles GET /api/v1/expiry-options
+func (h *Handler) APIExpiryOptions(w http.ResponseWriter, r *http.Request) {
+	policy := h.expiryPolicy(r)
+	writeAPIJSON(w, http.StatusOK, ExpiryOptionsResponse{
+		Options:              policy.Options(),
+		Default:              policy.Default(),
+		MaxRetentionSeconds:  int64(policy.MaxRetention() / time.Second),
+		DownloadLimitOptions: h.downloadLimitOptions(),
+		MaxDownloadsLimit:    h.Config.MaxDownloadsLimit,
+	})
+}
+
+// APICreateFile handles POST /api/v1/files. The request body is the file
+// content and the upload options are query parameters.
+func (h *Handler) APICreateFile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := CreateFileRequest{
+		Filename:    query.Get("filename"),
+		Expiry:      query.Get("expiry"),
+		IsEncrypted: query.Get("encrypted") == "true",
+	}
+
+	if value := query.Get("expiry"); value != "" && !h.expiryPolicy(r).IsValid(value) {
+		writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, fmt.Sprintf("Invalid expiry %q", value))
+		return
+	}
+	if value := query.Get("max_downloads"); value != "" {
+		maxDownloads, err := strconv.Atoi(value)
+		if err != nil || maxDownloads < 0 || maxDownloads > h.Config.MaxDownloadsLimit {
+			writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest,
+				fmt.Sprintf("max_downloads must be between 0 and %d", h.Config.MaxDownloadsLimit))
+			return
+		}
+		req.MaxDownloads = maxDownloads
+	}
+	if value := query.Get("encrypted_sample"); value != "" && req.IsEncrypted {
+		sample, err := utils.Base64Decode(value)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIErrorBadRequest, "Invalid encrypted_sample")
+			return
+		}
+		req.EncryptedSample = sample
+	}
+
+	fileMetadata, deleteToken, uploadErr := h.saveStreamedUpload(w, r, req)
+	if uploadErr != nil {
+		writeAPIError(w, uploadErr.Status, uploadErr.Code, uploadErr.Message)
+		return
+	}
+
+	response := CreateFileResponse{
+		File:        h.newFileMetadata(r, fileMetadata),
+		DeleteToken: deleteToken,
+	}
+	w.Header().Set("Location", response.File.URL)
+	writeAPIJSON(w, http.StatusCreated, response)
+}
+
+// APIGetFile handles GET /api/v1/files/{fileID}
+func (h *Handler) APIGetFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "fileID")
+
+	fileMetadata, err := h.Storage.GetFile(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIErrorNotFound, "File not found or has expired")
+		return
+	}
+
+	// Check if file has expired
+	if !fileMetadata.ExpiryTime.IsZero() && fileMetadata.ExpiryTime.Before(time.Now()) {
+		if err := h.Storage.DeleteFile(id); err != nil {
+			LogError(err, "Error deleting expired file", map[string]interface{}{
+				"file_id": id,
+			})
+		}
+		writeAPIError(w, http.StatusGone, APIErrorGone, "File has expired")
+		return
+	}
+	if fileMetadata.MaxDownloads > 0 && fileMetadata.DownloadsRemaining <= 0 {
+		writeAPIError(w, http.StatusGone, APIErrorGone, "File has reached its download limit")
+		return
+	}
+
+	writeAPIJSON(w, http.StatusOK, h.newFileMetadata(r, fileMetadata))
+}
+
+// APIDeleteFile handles DELETE /api/v1/files/{fileID} using the owner's
+// delete token from the X-Delete-Token header
+func (h *Handler) APIDeleteFile(w http.ResponseWriter, r *http.Request) {
+	fileID := chi.URLParam(r, "fileID")
+
+	switch h.deleteWithToken(fileID, r.Header.Get(DeleteTokenHeaderName)) {
+	case http.StatusOK:
+		w.WriteHeader(http.StatusNoContent)
+	case http.StatusNotFound:
+		writeAPIError(w, http.StatusNotFound, APIErrorNotFound, "File not found or has expired")
+	case http.StatusForbidden:
+		writeAPIError(w, http.StatusForbidden, APIErrorForbidden, "Invalid delete token")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, APIErrorInternal, "Error deleting file")
+	}
+}
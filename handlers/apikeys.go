@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+
+	"uploadfish/models"
+	"uploadfish/utils"
+)
+
+// maxUploadSize returns the largest upload allowed for the request, which
+// an API key may lower from the server's maximum. Keys never raise it, since
+// the database's value limit is sized from the server's maximum.
+func (h *Handler) maxUploadSize(r *http.Request) int64 {
+	if key := utils.APIKeyFromContext(r.Context()); key != nil && key.MaxUploadSize > 0 && key.MaxUploadSize < h.Config.MaxUploadSize {
+		return key.MaxUploadSize
+	}
+	return h.Config.MaxUploadSize
+}
+
+// expiryPolicy returns the expiry options for the request: the API key's
+// own options if it has any, otherwise the server's
+func (h *Handler) expiryPolicy(r *http.Request) *models.ExpiryPolicy {
+	key := utils.APIKeyFromContext(r.Context())
+	if key == nil {
+		return h.Expiry
+	}
+
+	policy, err := key.ExpiryPolicy(h.Expiry.MaxRetention())
+	if err != nil {
+		LogError(err, "Invalid API key expiry options, using server defaults", map[string]interface{}{
+			"api_key_id": key.ID,
+		})
+		return h.Expiry
+	}
+	if policy == nil {
+		return h.Expiry
+	}
+	return policy
+}
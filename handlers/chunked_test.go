@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"uploadfish/models"
+)
+
+// TestChunkedUploadSmallFile uploads a small file split into five chunks, as
+// the browser uploader does for files under 10MB
+func TestChunkedUploadSmallFile(t *testing.T) {
+	h := newTestHandler(t)
+	router := chi.NewRouter()
+	router.Post("/upload/chunk", h.ChunkUpload)
+	router.Post("/upload/finalize", h.FinalizeUpload)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	const totalChunks = 5
+	chunkSize := (len(content) + totalChunks - 1) / totalChunks
+	fileID := "5d1f0c2e-7a3b-4c8d-9e6f-0a1b2c3d4e5f"
+
+	// Tokens for later chunks, and finally for finalizing, arrive with the
+	// responses for earlier chunks
+	tokens := map[int]string{}
+	addTokens := func(first int, values interface{}) {
+		list, _ := values.([]interface{})
+		for i, token := range list {
+			tokens[first+i] = token.(string)
+		}
+	}
+
+	for index := 0; index < totalChunks; index++ {
+		chunk := content[index*chunkSize : min((index+1)*chunkSize, len(content))]
+		hash := sha256.Sum256(chunk)
+		headers := map[string]string{}
+		if index > 0 {
+			token, ok := tokens[index]
+			if !ok {
+				t.Fatalf("no token was issued for chunk %d", index)
+			}
+			headers[ChunkTokenHeaderName] = token
+		}
+
+		resp := postForm(t, server, h, "/upload/chunk", "chunk"+strconv.Itoa(index), map[string]string{
+			"file_id":      fileID,
+			"chunk_index":  strconv.Itoa(index),
+			"total_chunks": strconv.Itoa(totalChunks),
+			"file_size":    strconv.Itoa(len(content)),
+			"chunk_hash":   hex.EncodeToString(hash[:]),
+			"filename":     "small.bin",
+		}, chunk, headers)
+		if index == 0 {
+			addTokens(1, resp["initial_chunk_tokens"])
+		} else {
+			addTokens(index+1, resp["next_chunk_tokens"])
+		}
+	}
+
+	postForm(t, server, h, "/upload/finalize", "finalize", map[string]string{
+		"file_id": fileID,
+	}, nil, map[string]string{ChunkTokenHeaderName: tokens[totalChunks]})
+
+	stream, err := h.Storage.GetFileContentStream(fileID)
+	if err != nil {
+		t.Fatalf("GetFileContentStream: %v", err)
+	}
+	defer stream.Close()
+	stored, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("reading stored content: %v", err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored content does not match the upload")
+	}
+}
+
+func TestStaleUploadCleanupSkipsLockedUploads(t *testing.T) {
+	h := newTestHandler(t)
+	stale := time.Now().Add(-2 * time.Hour)
+	for _, id := range []string{"stale", "locked"} {
+		session := &models.UploadSession{ID: id, TotalChunks: 2, CreatedAt: stale, LastUpdated: stale}
+		if err := h.Storage.SaveUploadSession(session); err != nil {
+			t.Fatalf("SaveUploadSession: %v", err)
+		}
+		if err := os.MkdirAll(h.chunksDirFor(id), 0755); err != nil {
+			t.Fatalf("creating chunks directory: %v", err)
+		}
+	}
+	if !h.lockUpload("locked") {
+		t.Fatalf("lockUpload failed")
+	}
+
+	h.removeStaleUploadSessions(time.Hour)
+
+	if _, err := h.Storage.GetUploadSession("stale"); err == nil {
+		t.Errorf("stale session was not removed")
+	}
+	if _, err := os.Stat(h.chunksDirFor("stale")); !os.IsNotExist(err) {
+		t.Errorf("stale chunks were not removed")
+	}
+	if _, err := h.Storage.GetUploadSession("locked"); err != nil {
+		t.Errorf("session of a locked upload was removed: %v", err)
+	}
+	if _, err := os.Stat(h.chunksDirFor("locked")); err != nil {
+		t.Errorf("chunks of a locked upload were removed: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+
+	"uploadfish/models"
+	"uploadfish/storage"
+)
+
+// contentReadSeeker exposes stored file content as an io.ReadSeeker so it can
+// be served with http.ServeContent. Seeking is lazy: the underlying stream is
+// only reopened at the new position on the next Read.
+type contentReadSeeker struct {
+	store     *storage.Storage
+	file      *models.File
+	reader    io.ReadCloser
+	readerPos int64 // Position of the open reader in the decoded content
+	pos       int64 // Position requested by Seek
+	bytesRead int64
+	err       error // First read error other than io.EOF
+}
+
+// newContentReadSeeker opens the content of a file at offset 0 so that a
+// missing blob is reported before any response headers are written
+func newContentReadSeeker(store *storage.Storage, file *models.File) (*contentReadSeeker, error) {
+	reader, err := store.GetFileContentRange(file, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &contentReadSeeker{store: store, file: file, reader: reader}, nil
+}
+
+// Read reads from the current position, reopening the stream after a seek
+func (c *contentReadSeeker) Read(p []byte) (int, error) {
+	if c.reader == nil || c.readerPos != c.pos {
+		if c.reader != nil {
+			_ = c.reader.Close()
+			c.reader = nil
+		}
+		reader, err := c.store.GetFileContentRange(c.file, c.pos)
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		c.reader = reader
+		c.readerPos = c.pos
+	}
+
+	n, err := c.reader.Read(p)
+	c.readerPos += int64(n)
+	c.pos = c.readerPos
+	c.bytesRead += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Seek records the new position; the file size comes from the metadata
+func (c *contentReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = c.pos + offset
+	case io.SeekEnd:
+		pos = c.file.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 || pos > c.file.Size {
+		return 0, errors.New("seek position out of range")
+	}
+	c.pos = pos
+	return pos, nil
+}
+
+// Close closes the underlying stream
+func (c *contentReadSeeker) Close() error {
+	if c.reader == nil {
+		return nil
+	}
+	err := c.reader.Close()
+	c.reader = nil
+	return err
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"uploadfish/models"
+	"uploadfish/utils"
+)
+
+// newDeleteToken generates a secret delete token for a file and stores only
+// its hash in the metadata. The token is returned to the uploader once.
+func newDeleteToken(fileMetadata *models.File) (string, error) {
+	token, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	fileMetadata.DeleteTokenHash = utils.HashToken(token)
+	return token, nil
+}
+
+// deleteTokenCookieName is the one-time cookie that carries a new delete token
+// to the uploader's preview page, so the token never appears in a URL
+const deleteTokenCookieName = "delete_token"
+
+// deleteTokenFlashAge is how long the preview page has to pick up the token
+const deleteTokenFlashAge = 10 * time.Minute
+
+// setDeleteTokenFlash passes a file's delete token to the next view of its
+// preview page
+func setDeleteTokenFlash(w http.ResponseWriter, fileID, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     deleteTokenCookieName,
+		Value:    token,
+		Path:     "/file/" + fileID,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(deleteTokenFlashAge.Seconds()),
+	})
+}
+
+// takeDeleteTokenFlash returns the delete token passed to a preview page, if
+// any, and clears it so it is only shown once
+func takeDeleteTokenFlash(w http.ResponseWriter, r *http.Request, fileID string) string {
+	cookie, err := r.Cookie(deleteTokenCookieName)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deleteTokenCookieName,
+		Path:     "/file/" + fileID,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+	return cookie.Value
+}
+
+// validDeleteToken reports whether token matches the file's delete token
+func validDeleteToken(fileMetadata *models.File, token string) bool {
+	if token == "" || fileMetadata.DeleteTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(fileMetadata.DeleteTokenHash)) == 1
+}
+
+// deleteWithToken deletes a file if the token is valid and returns the HTTP
+// status describing the outcome
+func (h *Handler) deleteWithToken(fileID, token string) int {
+	fileMetadata, err := h.Storage.GetFile(fileID)
+	if err != nil {
+		return http.StatusNotFound
+	}
+
+	if !validDeleteToken(fileMetadata, token) {
+		LogInfo("Invalid delete token", map[string]interface{}{
+			"file_id": fileID,
+		})
+		return http.StatusForbidden
+	}
+
+	if err := h.Storage.DeleteFile(fileID); err != nil {
+		LogError(err, "Error deleting file with delete token", map[string]interface{}{
+			"file_id": fileID,
+		})
+		return http.StatusInternalServerError
+	}
+
+	LogInfo("File deleted by owner", map[string]interface{}{
+		"file_id": fileID,
+	})
+	return http.StatusOK
+}
+
+// DeleteFile handles DELETE /file/{fileID}. The delete token is read from the
+// X-Delete-Token header, never the URL, so it doesn't end up in logs. No CSRF
+// token is needed because the delete token itself authorizes the request.
+func (h *Handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	fileID := chi.URLParam(r, "fileID")
+
+	switch h.deleteWithToken(fileID, r.Header.Get(DeleteTokenHeaderName)) {
+	case http.StatusOK:
+		jsonResponse(w, map[string]interface{}{
+			"status":  "success",
+			"file_id": fileID,
+			"message": "File deleted",
+		})
+	case http.StatusNotFound:
+		jsonError(w, "File not found or has expired", http.StatusNotFound)
+	case http.StatusForbidden:
+		jsonError(w, "Invalid delete token", http.StatusForbidden)
+	default:
+		jsonError(w, "Error deleting file", http.StatusInternalServerError)
+	}
+}
+
+// DeleteFileForm handles POST /file/{fileID}/delete from the preview page
+func (h *Handler) DeleteFileForm(w http.ResponseWriter, r *http.Request) {
+	// Validate CSRF token
+	if !h.validateCSRF(w, r) {
+		return
+	}
+
+	fileID := chi.URLParam(r, "fileID")
+
+	switch h.deleteWithToken(fileID, r.FormValue("delete_token")) {
+	case http.StatusOK:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	case http.StatusNotFound:
+		h.renderError(w, r, "File not found or has expired", http.StatusNotFound)
+	case http.StatusForbidden:
+		h.renderError(w, r, "Invalid delete token", http.StatusForbidden)
+	default:
+		h.renderError(w, r, "Error deleting file", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Draining behaviour during shutdown
+const (
+	// DrainIdleTime is how long an upload may go without receiving data
+	// before a draining server stops waiting for it
+	DrainIdleTime = time.Minute
+	// DrainRetryAfter is the Retry-After, in seconds, of refused uploads
+	DrainRetryAfter = "60"
+	// DrainingMessage is the error returned for uploads refused while draining
+	DrainingMessage = "The server is restarting. Please try again in a minute."
+)
+
+// SetDraining marks the server as shutting down: /readyz fails so load
+// balancers stop sending it new requests, and new uploads are refused while
+// uploads in progress may finish
+func (h *Handler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Draining reports whether the server is shutting down
+func (h *Handler) Draining() bool {
+	return h.draining.Load()
+}
+
+// refuseNewUpload reports whether a new upload must be refused because the
+// server is draining, setting Retry-After for the caller's error response
+func (h *Handler) refuseNewUpload(w http.ResponseWriter, r *http.Request) bool {
+	if !h.Draining() {
+		return false
+	}
+	LogInfo("Refused new upload while draining", map[string]interface{}{
+		"path": r.URL.Path,
+		"ip":   r.RemoteAddr,
+	})
+	w.Header().Set("Retry-After", DrainRetryAfter)
+	return true
+}
+
+// WaitForUploads blocks until no chunked or tus upload has received data
+// within DrainIdleTime, or until ctx is done. Uploads abandoned by their
+// client are not waited for; their sessions survive the restart, so they can
+// still be resumed afterwards.
+func (h *Handler) WaitForUploads(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastActive := -1
+	for {
+		active, err := h.activeUploads()
+		if err != nil {
+			return err
+		}
+		if active == 0 {
+			return nil
+		}
+		if active != lastActive {
+			LogInfo("Waiting for uploads to finish", map[string]interface{}{
+				"active_uploads": active,
+			})
+			lastActive = active
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeUploads counts the upload sessions that received data within
+// DrainIdleTime
+func (h *Handler) activeUploads() (int, error) {
+	sessions, err := h.Storage.ListUploadSessions()
+	if err != nil {
+		return 0, err
+	}
+
+	active := 0
+	for _, session := range sessions {
+		if time.Since(session.LastUpdated) <= DrainIdleTime {
+			active++
+		}
+	}
+	return active, nil
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -15,24 +16,28 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"uploadfish/config"
+	"uploadfish/metrics"
 	"uploadfish/models"
 	"uploadfish/storage"
+	"uploadfish/tracing"
 	"uploadfish/utils"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
-	"github.com/prologic/bitcask"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // --- Constants ---
 const (
-	DefaultExpiry         = "1h"
 	CSRFCookieName        = "csrf_token"
 	CSRFHeaderName        = "X-CSRF-Token"
 	ChunkTokenHeaderName  = "X-Chunk-Token"
+	DeleteTokenHeaderName = "X-Delete-Token"
+	ResumeTokenHeaderName = "X-Resume-Token"
 	ChunkStateCleanupAge  = 3 * time.Hour
 	ChunkStateCleanupTick = 30 * time.Minute
 	// MaxChunkSizeLimit allows for large chunks plus form overhead. Tune as needed.
@@ -44,24 +49,22 @@ type Handler struct {
 	Config         *config.Config
 	Templates      *template.Template
 	Storage        *storage.Storage
+	Expiry         *models.ExpiryPolicy
 	csrfProtection *utils.CSRFProtection
-	// State for tracking chunked uploads
-	chunkStates   map[string]*chunkState
-	chunkStatesMu sync.Mutex
+	// Serializes read-modify-write updates of persisted upload sessions
+	sessionsMu sync.Mutex
+	// Uploads currently being modified by a tus request or finalized, guarded
+	// by sessionsMu
+	lockedUploads map[string]bool
+	// Set when the server starts shutting down
+	draining atomic.Bool
+	// Closed when the upload session cleanup routine has stopped
+	cleanupDone chan struct{}
 }
 
-// chunkState holds the validation state for an ongoing chunked upload
-type chunkState struct {
-	NextIndex    int          // DEPRECATED: Index check removed for concurrency. Retained for potential future use/logging.
-	TotalChunks  int          // Store total chunks for validation
-	UploadSecret string       // Secret key used for HMAC token generation for this upload
-	LastUpdated  time.Time    // Timestamp for cleaning up stale entries
-	IsEmptyFile  bool         // Flag to indicate a 0-byte file upload
-	FileMetadata *models.File // Store metadata for empty files to avoid disk I/O
-}
-
-// New creates a new Handler with the given configuration
-func New(cfg *config.Config, store *storage.Storage, csrfProtection *utils.CSRFProtection) *Handler {
+// New creates a new Handler with the given configuration. The upload session
+// cleanup routine runs until ctx is done; Wait blocks until it has stopped.
+func New(ctx context.Context, cfg *config.Config, store *storage.Storage, csrfProtection *utils.CSRFProtection, expiry *models.ExpiryPolicy) *Handler {
 	// Parse templates with dict helper function
 	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
 		"dict": func(values ...interface{}) (map[string]interface{}, error) {
@@ -89,39 +92,180 @@ func New(cfg *config.Config, store *storage.Storage, csrfProtection *utils.CSRFP
 		Config:         cfg,
 		Templates:      tmpl,
 		Storage:        store,
+		Expiry:         expiry,
 		csrfProtection: csrfProtection,
-		// Initialize the chunk state map
-		chunkStates: make(map[string]*chunkState),
+		lockedUploads:  make(map[string]bool),
+		cleanupDone:    make(chan struct{}),
 	}
 
-	// Start cleanup routine for chunk states
-	go h.cleanupStaleChunkStates(ChunkStateCleanupAge) // Use constant
+	// Start cleanup routine for upload sessions
+	go h.cleanupStaleUploadSessions(ctx, ChunkStateCleanupAge) // Use constant
 
 	return h
 }
 
-// cleanupStaleChunkStates periodically removes old chunk state entries
-func (h *Handler) cleanupStaleChunkStates(maxAge time.Duration) {
+// Wait blocks until the background cleanup routine has stopped, so storage
+// can be closed safely
+func (h *Handler) Wait() {
+	<-h.cleanupDone
+}
+
+// cleanupStaleUploadSessions periodically removes abandoned chunked uploads
+// until ctx is done
+func (h *Handler) cleanupStaleUploadSessions(ctx context.Context, maxAge time.Duration) {
+	defer close(h.cleanupDone)
 	ticker := time.NewTicker(ChunkStateCleanupTick) // Use constant
 	defer ticker.Stop()
 
-	for range ticker.C {
-		h.chunkStatesMu.Lock()
-		now := time.Now()
-		cleanedCount := 0
-		for fileID, state := range h.chunkStates {
-			if now.Sub(state.LastUpdated) > maxAge {
-				delete(h.chunkStates, fileID)
-				cleanedCount++
-			}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		if cleanedCount > 0 {
-			LogInfo("Cleaned up stale chunk states", map[string]interface{}{
-				"count": cleanedCount,
-			})
+
+		h.removeStaleUploadSessions(maxAge)
+	}
+}
+
+// removeStaleUploadSessions deletes sessions not updated within maxAge along
+// with their chunks, and chunk directories left without a session
+func (h *Handler) removeStaleUploadSessions(maxAge time.Duration) {
+	sessions, err := h.Storage.ListUploadSessions()
+	if err != nil {
+		LogError(err, "Error listing upload sessions for cleanup", nil)
+		return
+	}
+
+	now := time.Now()
+	cleanedCount := 0
+	active := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		if now.Sub(session.LastUpdated) <= maxAge {
+			active[session.ID] = true
+			continue
+		}
+		if !h.removeStaleUpload(session.ID, maxAge) {
+			active[session.ID] = true
+			continue
+		}
+		cleanedCount++
+	}
+
+	// Remove chunk directories orphaned by uploads that lost their session
+	entries, err := os.ReadDir(h.chunksRoot())
+	if err != nil && !os.IsNotExist(err) {
+		LogError(err, "Error reading chunks directory for cleanup", nil)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || active[entry.Name()] || now.Sub(info.ModTime()) <= maxAge {
+			continue
 		}
-		h.chunkStatesMu.Unlock()
+		if h.removeStaleUpload(entry.Name(), maxAge) {
+			cleanedCount++
+		}
+	}
+
+	if cleanedCount > 0 {
+		LogInfo("Cleaned up stale upload sessions", map[string]interface{}{
+			"count": cleanedCount,
+		})
+	}
+}
+
+// removeStaleUpload deletes an upload's session and chunks. It returns false
+// without deleting anything if a request holds the upload or its session has
+// been updated within maxAge since it was listed.
+func (h *Handler) removeStaleUpload(fileID string, maxAge time.Duration) bool {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	if h.lockedUploads[fileID] {
+		return false
+	}
+	session, err := h.Storage.GetUploadSession(fileID)
+	switch {
+	case err == storage.ErrNotFound:
+		// Only the chunks are left
+	case err != nil:
+		LogError(err, "Error loading upload session for cleanup", map[string]interface{}{"file_id": fileID})
+		return false
+	case time.Since(session.LastUpdated) <= maxAge:
+		return false
+	default:
+		if err := h.Storage.DeleteUploadSession(fileID); err != nil {
+			LogError(err, "Error deleting stale upload session", map[string]interface{}{"file_id": fileID})
+			return false
+		}
+	}
+
+	if err := os.RemoveAll(h.chunksDirFor(fileID)); err != nil {
+		LogError(err, "Error removing stale chunks directory", map[string]interface{}{"file_id": fileID})
+		return false
+	}
+	return true
+}
+
+// chunksRoot returns the directory holding the chunks of all uploads. It is
+// kept with the database by default so sessions and their chunks survive a
+// restart together.
+func (h *Handler) chunksRoot() string {
+	return h.Config.ChunkPath
+}
+
+// chunksDirFor returns the directory holding a chunked upload's chunks
+func (h *Handler) chunksDirFor(fileID string) string {
+	return filepath.Join(h.chunksRoot(), fileID)
+}
+
+// chunkPath returns the file holding one chunk of a chunked upload
+func (h *Handler) chunkPath(fileID string, chunkIndex int) string {
+	return filepath.Join(h.chunksDirFor(fileID), fmt.Sprintf("chunk_%d", chunkIndex))
+}
+
+// dropMissingChunks removes chunks whose files no longer exist, e.g. because
+// the chunk directory was lost, from the session's received chunks so the
+// client sends them again. The caller must hold sessionsMu.
+func (h *Handler) dropMissingChunks(session *models.UploadSession) error {
+	var dropped []int
+	for index := range session.ReceivedChunks {
+		if _, err := os.Stat(h.chunkPath(session.ID, index)); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			delete(session.ReceivedChunks, index)
+			dropped = append(dropped, index)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	LogInfo("Dropped received chunks missing from disk", map[string]interface{}{
+		"file_id": session.ID,
+		"chunks":  len(dropped),
+	})
+	return h.Storage.SaveUploadSession(session)
+}
+
+// recordChunk marks a hash-verified chunk as received in the upload session.
+// update, if not nil, may change other session fields in the same write.
+func (h *Handler) recordChunk(fileID string, chunkIndex int, hash string, update func(*models.UploadSession)) error {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	session, err := h.Storage.GetUploadSession(fileID)
+	if err != nil {
+		return err
+	}
+
+	session.MarkChunkReceived(chunkIndex, hash)
+	session.LastUpdated = time.Now()
+	if update != nil {
+		update(session)
 	}
+	return h.Storage.SaveUploadSession(session)
 }
 
 // Index renders the main upload page
@@ -132,15 +276,19 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 
 	// Prepare template data
 	data := struct {
-		MaxSizeMB     int64
-		AllowedTypes  string
-		ExpiryOptions []models.ExpiryOption
-		CSRFToken     string
+		MaxSizeMB            int64
+		AllowedTypes         string
+		ExpiryOptions        []models.ExpiryOption
+		DefaultExpiry        string
+		DownloadLimitOptions []models.ExpiryOption
+		CSRFToken            string
 	}{
-		MaxSizeMB:     h.Config.MaxUploadSize / (1 << 20),
-		AllowedTypes:  getAllowedTypesDisplay(h.Config.AllowedTypes),
-		ExpiryOptions: models.GetExpiryOptions(),
-		CSRFToken:     tokens.FormToken,
+		MaxSizeMB:            h.Config.MaxUploadSize / (1 << 20),
+		AllowedTypes:         getAllowedTypesDisplay(h.Config.AllowedTypes),
+		ExpiryOptions:        h.Expiry.Options(),
+		DefaultExpiry:        h.Expiry.Default(),
+		DownloadLimitOptions: h.downloadLimitOptions(),
+		CSRFToken:            tokens.FormToken,
 	}
 
 	h.renderTemplate(w, r, "index.html", data, 0)
@@ -154,15 +302,21 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.refuseNewUpload(w, r) {
+		h.renderError(w, r, DrainingMessage, http.StatusServiceUnavailable)
+		return
+	}
+
 	// Set max upload size
-	r.Body = http.MaxBytesReader(w, r.Body, h.Config.MaxUploadSize)
+	maxUploadSize := h.maxUploadSize(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
 
 	// Parse the multipart form
-	if err := r.ParseMultipartForm(h.Config.MaxUploadSize); err != nil {
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
 		LogError(err, "Error parsing multipart form", map[string]interface{}{
-			"max_size": h.Config.MaxUploadSize,
+			"max_size": maxUploadSize,
 		})
-		h.renderError(w, r, fmt.Sprintf("The uploaded file is too big. Please choose a file that's less than %d MB.", h.Config.MaxUploadSize/(1<<20)), http.StatusBadRequest)
+		h.renderError(w, r, fmt.Sprintf("The uploaded file is too big. Please choose a file that's less than %d MB.", maxUploadSize/(1<<20)), http.StatusBadRequest)
 		return
 	}
 
@@ -194,8 +348,16 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Generate the owner's delete token
+	deleteToken, err := newDeleteToken(fileMetadata)
+	if err != nil {
+		LogError(err, "Failed to generate delete token", nil)
+		h.renderError(w, r, "Server error preparing upload", http.StatusInternalServerError)
+		return
+	}
+
 	// Save to storage
-	if err := h.Storage.SaveFile(fileMetadata, file); err != nil {
+	if err := h.Storage.SaveFile(r.Context(), fileMetadata, file); err != nil {
 		LogError(err, "Error saving file", map[string]interface{}{
 			"file_id":   fileMetadata.ID,
 			"file_size": fileMetadata.Size,
@@ -204,6 +366,8 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	metrics.BytesReceived.Add(float64(fileMetadata.Size))
+	metrics.RecordUpload(metrics.UploadSingle, fileMetadata.Size)
 	LogInfo("File uploaded successfully", map[string]interface{}{
 		"filename":  fileMetadata.Filename,
 		"size":      fileMetadata.Size,
@@ -211,16 +375,23 @@ func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 		"file_id":   fileMetadata.ID,
 	})
 
-	// Redirect to the preview page
+	// Redirect to the preview page, which shows the owner the delete token
+	setDeleteTokenFlash(w, fileMetadata.ID, deleteToken)
 	previewURL := fmt.Sprintf("%s/file/%s", h.getBaseURL(r), fileMetadata.ID)
 	http.Redirect(w, r, previewURL, http.StatusSeeOther)
 }
 
 // validateCSRF validates the CSRF token and returns true if valid
 func (h *Handler) validateCSRF(w http.ResponseWriter, r *http.Request) bool {
+	// Requests authenticated with an API key carry no cookies to forge
+	if utils.APIKeyFromContext(r.Context()) != nil {
+		return true
+	}
+
 	csrfToken := r.FormValue("csrf_token")
 	cookie, err := r.Cookie(CSRFCookieName) // Use constant
 	if err != nil {
+		metrics.CSRFRejections.Inc()
 		LogInfo("Invalid or missing CSRF token", map[string]interface{}{
 			"ip": r.RemoteAddr,
 		})
@@ -229,6 +400,7 @@ func (h *Handler) validateCSRF(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	if csrfToken == "" || !h.csrfProtection.ValidateToken(csrfToken, cookie.Value) {
+		metrics.CSRFRejections.Inc()
 		LogInfo("Invalid or missing CSRF token", map[string]interface{}{
 			"ip": r.RemoteAddr,
 		})
@@ -239,39 +411,81 @@ func (h *Handler) validateCSRF(w http.ResponseWriter, r *http.Request) bool {
 }
 
 // parseAndValidateExpiry parses the expiry string and returns the calculated time.
-func parseAndValidateExpiry(expiryValue string) (time.Time, string) {
+func (h *Handler) parseAndValidateExpiry(r *http.Request, expiryValue string) (time.Time, string) {
+	policy := h.expiryPolicy(r)
+
 	if expiryValue == "" {
 		LogInfo("No expiry value provided, using default", map[string]interface{}{
-			"default_expiry": DefaultExpiry,
+			"default_expiry": policy.Default(),
 		})
-		expiryValue = DefaultExpiry // Use constant
+		expiryValue = policy.Default()
 	}
 
 	// Validate expiry value against allowed options
-	validExpiryValues := map[string]bool{"1h": true, "6h": true, "24h": true, "72h": true, "when_downloaded": true}
-	if !validExpiryValues[expiryValue] {
+	if !policy.IsValid(expiryValue) {
 		LogInfo("Invalid expiry value provided, using default", map[string]interface{}{
 			"provided_expiry": expiryValue,
-			"default_expiry":  DefaultExpiry,
+			"default_expiry":  policy.Default(),
 		})
-		expiryValue = DefaultExpiry // Use constant
+		expiryValue = policy.Default()
 	}
 
-	var expiryTime time.Time
-	if expiryValue != "when_downloaded" {
-		expiryDuration := models.ParseExpiryDuration(expiryValue) // Assumes this handles parsing safely
-		expiryTime = time.Now().Add(expiryDuration)
-	}
-	// else leave expiryTime as zero for "when_downloaded"
+	// Zero for "when_downloaded" unless a maximum retention is configured
+	expiryTime := policy.ExpiryTime(expiryValue, time.Now())
 
 	return expiryTime, expiryValue // Return validated value as well
 }
 
+// parseMaxDownloads parses the requested download limit, capped at the
+// configured maximum. "when_downloaded" is a limit of a single download.
+// Returns 0 when the file may be downloaded any number of times.
+func (h *Handler) parseMaxDownloads(maxDownloadsValue string, expiryValue string) int {
+	if expiryValue == models.ExpiryWhenDownloaded {
+		return 1
+	}
+	if maxDownloadsValue == "" {
+		return 0
+	}
+
+	maxDownloads, err := strconv.Atoi(maxDownloadsValue)
+	if err != nil || maxDownloads < 0 {
+		LogInfo("Invalid download limit provided, ignoring", map[string]interface{}{
+			"provided_max_downloads": maxDownloadsValue,
+		})
+		return 0
+	}
+	return h.limitMaxDownloads(maxDownloads, expiryValue)
+}
+
+// limitMaxDownloads caps a download limit at the configured maximum.
+// "when_downloaded" files always allow a single download.
+func (h *Handler) limitMaxDownloads(maxDownloads int, expiryValue string) int {
+	if expiryValue == models.ExpiryWhenDownloaded {
+		return 1
+	}
+	if maxDownloads > h.Config.MaxDownloadsLimit {
+		maxDownloads = h.Config.MaxDownloadsLimit
+	}
+	return maxDownloads
+}
+
+// downloadLimitOptions returns the download limit options allowed by the configuration
+func (h *Handler) downloadLimitOptions() []models.ExpiryOption {
+	var options []models.ExpiryOption
+	for _, option := range models.GetDownloadLimitOptions() {
+		if limit, err := strconv.Atoi(option.Value); err == nil && limit <= h.Config.MaxDownloadsLimit {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
 // processUploadedFile processes and validates an uploaded file
 func (h *Handler) processUploadedFile(file io.ReadSeeker, handler *multipart.FileHeader, r *http.Request) (*models.File, error) {
 	// Get expiry option using helper
 	expiryValueRaw := r.FormValue("expiry")
-	expiryTime, expiryValueValidated := parseAndValidateExpiry(expiryValueRaw)
+	expiryTime, expiryValueValidated := h.parseAndValidateExpiry(r, expiryValueRaw)
+	maxDownloads := h.parseMaxDownloads(r.FormValue("max_downloads"), expiryValueValidated)
 
 	// Check if the file is encrypted client-side
 	isEncrypted := false
@@ -342,15 +556,17 @@ func (h *Handler) processUploadedFile(file io.ReadSeeker, handler *multipart.Fil
 	}
 
 	return &models.File{
-		ID:              fileID,
-		Filename:        sanitizeFilename(handler.Filename),
-		MimeType:        contentType,
-		Size:            size, // Use size obtained from seeking
-		UploadTime:      time.Now(),
-		ExpiryValue:     expiryValueValidated, // Store validated value
-		ExpiryTime:      expiryTime,           // Store calculated time (or zero)
-		IsEncrypted:     isEncrypted,
-		EncryptedSample: encryptedSample,
+		ID:                 fileID,
+		Filename:           sanitizeFilename(handler.Filename),
+		MimeType:           contentType,
+		Size:               size, // Use size obtained from seeking
+		UploadTime:         time.Now(),
+		ExpiryValue:        expiryValueValidated, // Store validated value
+		ExpiryTime:         expiryTime,           // Store calculated time (or zero)
+		IsEncrypted:        isEncrypted,
+		EncryptedSample:    encryptedSample,
+		MaxDownloads:       maxDownloads,
+		DownloadsRemaining: maxDownloads,
 	}, nil
 }
 
@@ -419,8 +635,28 @@ func (h *Handler) ServeFileByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check if file has used up its download limit
+	if fileMetadata.MaxDownloads > 0 && fileMetadata.DownloadsRemaining <= 0 {
+		h.renderError(w, r, "This file has reached its download limit and is no longer available", http.StatusGone)
+		return
+	}
+
 	// If this is a direct download, serve the file directly
 	if r.URL.Query().Get("dl") == "true" {
+		// Take one download from the file's limit. HEAD requests send no
+		// content, so they don't count.
+		if fileMetadata.HasDownloadLimit() && r.Method != http.MethodHead {
+			claimed, err := h.Storage.ClaimDownload(id)
+			if err == storage.ErrDownloadLimitReached {
+				h.renderError(w, r, "This file has reached its download limit and is no longer available", http.StatusGone)
+				return
+			} else if err != nil {
+				h.renderError(w, r, "File not found or has expired", http.StatusNotFound)
+				return
+			}
+			fileMetadata = claimed
+		}
+
 		serveFileContent(w, r, h.Storage, fileMetadata)
 		return
 	}
@@ -430,11 +666,13 @@ func (h *Handler) ServeFileByID(w http.ResponseWriter, r *http.Request) {
 }
 
 // Helper function to serve file content
-func serveFileContent(w http.ResponseWriter, r *http.Request, storage *storage.Storage, fileMetadata *models.File) {
+func serveFileContent(w http.ResponseWriter, r *http.Request, store *storage.Storage, fileMetadata *models.File) {
+	start := time.Now()
+
 	// Get file content stream
-	reader, err := storage.GetFileContentStream(fileMetadata.ID)
+	reader, err := newContentReadSeeker(store, fileMetadata)
 	if err != nil {
-		if err == bitcask.ErrKeyNotFound { // Handle not found specifically
+		if err == storage.ErrNotFound { // Handle not found specifically
 			http.Error(w, "File not found", http.StatusNotFound)
 		} else {
 			LogError(err, "Error retrieving file content stream", map[string]interface{}{"file_id": fileMetadata.ID})
@@ -444,13 +682,15 @@ func serveFileContent(w http.ResponseWriter, r *http.Request, storage *storage.S
 	}
 	defer reader.Close() // Ensure the stream is closed
 
-	// --- Check for "When Viewed" expiry ---
-	shouldDeleteAfterServe := false
+	// --- Check for download limit expiry ---
+	// The download has already been claimed, so the last one deletes the file
+	isLimited := fileMetadata.HasDownloadLimit() && r.Method != http.MethodHead
+	shouldDeleteAfterServe := isLimited && fileMetadata.DownloadsRemaining <= 0
 
-	if fileMetadata.ExpiryValue == "when_downloaded" {
-		shouldDeleteAfterServe = true // Mark for deletion regardless of key
-		LogInfo("'When Viewed' file accessed, scheduling deletion after serve", map[string]interface{}{
-			"file_id": fileMetadata.ID,
+	if shouldDeleteAfterServe {
+		LogInfo("Last allowed download accessed, scheduling deletion after serve", map[string]interface{}{
+			"file_id":       fileMetadata.ID,
+			"max_downloads": fileMetadata.MaxDownloads,
 		})
 	}
 	// --------------------------------------
@@ -477,23 +717,51 @@ func serveFileContent(w http.ResponseWriter, r *http.Request, storage *storage.S
 		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", fileMetadata.Filename))
 	}
 
-	// Set content length
-	w.Header().Set("Content-Length", strconv.FormatInt(fileMetadata.Size, 10))
+	var bytesWritten int64
+	var copyErr error
+	if fileMetadata.HasDownloadLimit() {
+		// Files with a download limit are always served whole, so each
+		// download counts once and deletion only follows a complete download
+		w.Header().Set("Accept-Ranges", "none")
+		w.Header().Set("Content-Length", strconv.FormatInt(fileMetadata.Size, 10))
+		if r.Method == http.MethodHead {
+			return
+		}
 
-	// Stream the content directly to the response using io.Copy
-	bytesWritten, copyErr := io.Copy(w, reader)
+		// Stream the content directly to the response using io.Copy
+		bytesWritten, copyErr = io.Copy(w, reader)
+	} else {
+		// ServeContent handles Range, If-Range and conditional requests.
+		// Content never changes for a given ID, so the ID is a strong ETag.
+		w.Header().Set("ETag", fmt.Sprintf("%q", fileMetadata.ID))
+		http.ServeContent(w, r, fileMetadata.Filename, fileMetadata.UploadTime, reader)
+		bytesWritten, copyErr = reader.bytesRead, reader.err
+	}
+	if r.Method != http.MethodHead {
+		metrics.BytesSent.Add(float64(bytesWritten))
+		metrics.DownloadDuration.Observe(time.Since(start).Seconds())
+	}
 
 	// --- Execute deletion if scheduled and copy was successful ---
 	if copyErr == nil && shouldDeleteAfterServe {
-		LogInfo("File stream successful, executing 'When Viewed' deletion", map[string]interface{}{
+		LogInfo("File stream successful, executing download limit deletion", map[string]interface{}{
 			"file_id": fileMetadata.ID,
 		})
-		if err := storage.DeleteFile(fileMetadata.ID); err != nil {
-			LogError(err, "Error deleting file after 'When Viewed' download", map[string]interface{}{
+		if err := store.DeleteFile(fileMetadata.ID); err != nil {
+			LogError(err, "Error deleting file after last allowed download", map[string]interface{}{
 				"file_id": fileMetadata.ID,
 			})
 		} else {
-			LogInfo("'When Viewed' file deleted successfully after download", map[string]interface{}{
+			LogInfo("File deleted successfully after last allowed download", map[string]interface{}{
+				"file_id": fileMetadata.ID,
+			})
+		}
+	}
+
+	// An interrupted download gives its claim back
+	if copyErr != nil && isLimited {
+		if err := store.ReleaseDownload(fileMetadata.ID); err != nil {
+			LogError(err, "Error releasing download after failed transfer", map[string]interface{}{
 				"file_id": fileMetadata.ID,
 			})
 		}
@@ -533,6 +801,15 @@ func servePreviewPage(w http.ResponseWriter, r *http.Request, h *Handler, fileMe
 	isVideo := strings.HasPrefix(fileMetadata.MimeType, "video/")
 	isAudio := strings.HasPrefix(fileMetadata.MimeType, "audio/")
 
+	// Only offer deletion to the owner, right after the upload
+	deleteToken := takeDeleteTokenFlash(w, r, fileMetadata.ID)
+	if !validDeleteToken(fileMetadata, deleteToken) {
+		deleteToken = ""
+	}
+	if deleteToken != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
 	// Generate CSRF token for the page
 	// NOTE: Using GenerateTokenPair here might be safer if forms exist on preview
 	tokens := h.csrfProtection.GenerateTokenPair()
@@ -557,6 +834,10 @@ func servePreviewPage(w http.ResponseWriter, r *http.Request, h *Handler, fileMe
 		IsAudio             bool
 		CSRFToken           string
 		IsEncrypted         bool
+		FileID              string
+		DeleteToken         string
+		MaxDownloads        int
+		DownloadsRemaining  int
 	}{
 		Filename:            fileMetadata.Filename,
 		MimeType:            fileMetadata.MimeType,
@@ -575,6 +856,10 @@ func servePreviewPage(w http.ResponseWriter, r *http.Request, h *Handler, fileMe
 		IsAudio:             isAudio,
 		CSRFToken:           tokens.FormToken, // Use form token from pair
 		IsEncrypted:         fileMetadata.IsEncrypted,
+		FileID:              fileMetadata.ID,
+		DeleteToken:         deleteToken,
+		MaxDownloads:        fileMetadata.MaxDownloads,
+		DownloadsRemaining:  fileMetadata.DownloadsRemaining,
 	}
 
 	// Serve the preview template
@@ -701,7 +986,7 @@ func sanitizeFilename(filename string) string {
 	}
 
 	// If sanitization removes everything, provide a default name
-	if sanitized == "" {
+	if sanitized == "" || sanitized == "." || sanitized == string(filepath.Separator) {
 		sanitized = "file"
 	}
 
@@ -802,6 +1087,11 @@ func (h *Handler) renderTemplate(w http.ResponseWriter, r *http.Request, templat
 
 // validateChunkCSRF checks CSRF token leniently for chunk/finalize uploads
 func (h *Handler) validateChunkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	// Requests authenticated with an API key carry no cookies to forge
+	if utils.APIKeyFromContext(r.Context()) != nil {
+		return true
+	}
+
 	csrfToken := r.FormValue("csrf_token")
 	if csrfToken == "" {
 		csrfToken = r.Header.Get(CSRFHeaderName) // Use constant
@@ -815,6 +1105,7 @@ func (h *Handler) validateChunkCSRF(w http.ResponseWriter, r *http.Request) bool
 		return true
 	} else {
 		// No valid token/cookie match - reject
+		metrics.CSRFRejections.Inc()
 		LogInfo("Invalid CSRF protection for chunk/finalize upload", map[string]interface{}{
 			"ip":             r.RemoteAddr,
 			"path":           r.URL.Path,
@@ -875,9 +1166,25 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Bounding the number of chunks keeps the upload session small
+	if totalChunks < 0 || totalChunks > models.MaxUploadChunks {
+		jsonError(w, fmt.Sprintf("Too many chunks. An upload may have at most %d chunks.", models.MaxUploadChunks), http.StatusBadRequest)
+		return
+	}
+
+	// Only uploads without a session are new. Chunks of uploads already in
+	// progress, including a first chunk sent again, are still accepted while
+	// draining.
+	if h.Draining() {
+		if _, err := h.Storage.GetUploadSession(fileID); err == storage.ErrNotFound && h.refuseNewUpload(w, r) {
+			jsonError(w, DrainingMessage, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	// Validate file size
-	if fileSize > h.Config.MaxUploadSize {
-		jsonError(w, fmt.Sprintf("File too large. Maximum size is %d MB.", h.Config.MaxUploadSize/(1<<20)), http.StatusBadRequest)
+	if fileSize > h.maxUploadSize(r) {
+		jsonError(w, fmt.Sprintf("File too large. Maximum size is %d MB.", h.maxUploadSize(r)/(1<<20)), http.StatusBadRequest)
 		return
 	}
 
@@ -887,11 +1194,9 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 			"file_id": fileID,
 		})
 
-		h.chunkStatesMu.Lock()
 		// Generate a secret, but mark as empty file and store minimal metadata
 		uploadSecret, err := utils.GenerateRandomString(32)
 		if err != nil {
-			h.chunkStatesMu.Unlock()
 			LogError(err, "Failed to generate upload secret for empty file", nil)
 			jsonError(w, "Server error preparing empty file upload", http.StatusInternalServerError)
 			return
@@ -899,7 +1204,8 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 
 		// Get other metadata needed for finalization
 		expiryValueRaw := r.FormValue("expiry")
-		expiryTime, expiryValueValidated := parseAndValidateExpiry(expiryValueRaw)
+		expiryTime, expiryValueValidated := h.parseAndValidateExpiry(r, expiryValueRaw)
+		maxDownloads := h.parseMaxDownloads(r.FormValue("max_downloads"), expiryValueValidated)
 		isEncrypted := r.FormValue("encrypted") == "true" // Sample not possible for empty file
 		filenameValue := r.FormValue("filename")          // Assume filename is sent as form value for empty files
 		if filenameValue == "" {
@@ -912,24 +1218,33 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		h.chunkStates[fileID] = &chunkState{
+		now := time.Now()
+		session := &models.UploadSession{
+			ID:           fileID,
 			IsEmptyFile:  true,
 			UploadSecret: uploadSecret, // Still needed for finalization HMAC maybe? Or different validation?
-			LastUpdated:  time.Now(),
+			CreatedAt:    now,
+			LastUpdated:  now,
 			TotalChunks:  0,
 			FileMetadata: &models.File{ // Store metadata directly
-				ID:              fileID,
-				Filename:        sanitizeFilename(filenameValue),
-				MimeType:        "application/octet-stream", // Default for empty
-				Size:            0,
-				UploadTime:      time.Now(),
-				ExpiryValue:     expiryValueValidated,
-				ExpiryTime:      expiryTime,
-				IsEncrypted:     isEncrypted,
-				EncryptedSample: nil, // No sample for empty files
+				ID:                 fileID,
+				Filename:           sanitizeFilename(filenameValue),
+				MimeType:           "application/octet-stream", // Default for empty
+				Size:               0,
+				UploadTime:         time.Now(),
+				ExpiryValue:        expiryValueValidated,
+				ExpiryTime:         expiryTime,
+				IsEncrypted:        isEncrypted,
+				EncryptedSample:    nil, // No sample for empty files
+				MaxDownloads:       maxDownloads,
+				DownloadsRemaining: maxDownloads,
 			},
 		}
-		h.chunkStatesMu.Unlock()
+		if err := h.Storage.SaveUploadSession(session); err != nil {
+			LogError(err, "Failed to save upload session for empty file", map[string]interface{}{"file_id": fileID})
+			jsonError(w, "Server error preparing empty file upload", http.StatusInternalServerError)
+			return
+		}
 
 		// Respond immediately, telling client to finalize
 		jsonResponse(w, map[string]interface{}{
@@ -944,16 +1259,17 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	// --- End Empty File Handling ---
 
 	// Validate file size against global limit (after empty file check)
-	if fileSize > h.Config.MaxUploadSize {
-		jsonError(w, fmt.Sprintf("File too large. Maximum size is %d MB.", h.Config.MaxUploadSize/(1<<20)), http.StatusBadRequest)
+	if fileSize > h.maxUploadSize(r) {
+		jsonError(w, fmt.Sprintf("File too large. Maximum size is %d MB.", h.maxUploadSize(r)/(1<<20)), http.StatusBadRequest)
 		return
 	}
 
 	// --- Chunk Token Validation & Generation ---
 	var initialTokens []string // For chunk 0 response
 	var nextTokens []string    // For subsequent chunks
+	var resumeToken string     // For chunk 0 response, used to query upload status
 
-	h.chunkStatesMu.Lock() // Lock before accessing shared state
+	h.sessionsMu.Lock() // Lock before accessing the upload session
 
 	const maxConcurrent = 3 // Hardcoding for now, ideally from config or constant
 
@@ -961,7 +1277,7 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		// First chunk (non-empty file): Generate initial chunk secret and calculate tokens for the initial concurrent batch
 		uploadSecret, err := utils.GenerateRandomString(32) // Handle error
 		if err != nil {
-			h.chunkStatesMu.Unlock()
+			h.sessionsMu.Unlock()
 			LogError(err, "Failed to generate upload secret", nil)
 			jsonError(w, "Server error generating upload secret", http.StatusInternalServerError)
 			return
@@ -983,10 +1299,21 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		h.chunkStates[fileID] = &chunkState{
+		resumeToken = uploadResumeToken(uploadSecret)
+
+		now := time.Now()
+		session := &models.UploadSession{
+			ID:           fileID,
 			TotalChunks:  totalChunks, // Store total chunks
 			UploadSecret: uploadSecret,
-			LastUpdated:  time.Now(),
+			CreatedAt:    now,
+			LastUpdated:  now,
+		}
+		if err := h.Storage.SaveUploadSession(session); err != nil {
+			h.sessionsMu.Unlock()
+			LogError(err, "Failed to save upload session", map[string]interface{}{"file_id": fileID})
+			jsonError(w, "Server error starting upload", http.StatusInternalServerError)
+			return
 		}
 		// nextTokens remains empty for chunk 0 response
 		LogInfo("Initialized chunk state for upload", map[string]interface{}{
@@ -996,9 +1323,12 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		})
 	} else {
 		// Subsequent chunks: Validate incoming token and index
-		state, exists := h.chunkStates[fileID]
-		if !exists {
-			h.chunkStatesMu.Unlock()
+		state, err := h.Storage.GetUploadSession(fileID)
+		if err != nil {
+			h.sessionsMu.Unlock()
+			if err != storage.ErrNotFound {
+				LogError(err, "Error loading upload session", map[string]interface{}{"file_id": fileID, "chunk": chunkIndex})
+			}
 			LogInfo("Chunk state not found for file ID", map[string]interface{}{"file_id": fileID, "chunk": chunkIndex})
 			jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
 			return
@@ -1019,7 +1349,7 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		// Validate token using HMAC (Removed index check to allow concurrency)
 		expectedToken := utils.GenerateHMAC(state.UploadSecret, fmt.Sprintf("chunk%d", chunkIndex))
 		if chunkToken != expectedToken {
-			h.chunkStatesMu.Unlock()
+			h.sessionsMu.Unlock()
 			LogInfo("Chunk validation failed (Token mismatch)", map[string]interface{}{
 				"file_id":           fileID,
 				"received_index":    chunkIndex,
@@ -1055,7 +1385,6 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		// 	LogInfo("Chunk processed out of order but token was valid", map[string]interface{}{"file_id": fileID, "received_index": chunkIndex, "expected_index": state.NextIndex})
 		// 	// DO NOT increment state.NextIndex here.
 		// }
-		state.LastUpdated = time.Now() // Update timestamp regardless of order
 		LogInfo("Validated chunk token and generated next batch of tokens", map[string]interface{}{
 			"file_id":           fileID,
 			"chunk":             chunkIndex,
@@ -1064,7 +1393,7 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	h.chunkStatesMu.Unlock() // Unlock after accessing shared state
+	h.sessionsMu.Unlock() // Unlock after accessing the upload session
 	// ------------------------------------
 
 	// Get file chunk from request
@@ -1092,7 +1421,7 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	hasher := sha256.New()
 
 	// Create temp directory for chunks if it doesn't exist
-	chunksDir := filepath.Join(os.TempDir(), "uploadfish", "chunks", fileID)
+	chunksDir := h.chunksDirFor(fileID)
 	if err := os.MkdirAll(chunksDir, 0755); err != nil {
 		LogError(err, "Error creating chunks directory", map[string]interface{}{
 			"file_id":    fileID,
@@ -1102,12 +1431,17 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare path for the temporary chunk file
-	chunkPath := filepath.Join(chunksDir, fmt.Sprintf("chunk_%d", chunkIndex))
+	// Prepare path for the chunk file
+	chunkPath := h.chunkPath(fileID, chunkIndex)
+
+	// Trace the write of the chunk to temporary storage
+	_, writeSpan := tracing.Start(r.Context(), "upload.writeChunk",
+		tracing.FileIDKey.String(fileID), tracing.ChunkIndexKey.Int(chunkIndex))
 
 	// Create the temporary chunk file
 	chunkFile, err := os.Create(chunkPath)
 	if err != nil {
+		tracing.End(writeSpan, err)
 		LogError(err, "Error creating temporary chunk file", map[string]interface{}{
 			"file_id":    fileID,
 			"chunk":      chunkIndex,
@@ -1124,6 +1458,9 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	// This simultaneously writes the file AND calculates the hash
 	writtenBytes, err := io.Copy(chunkFile, teeReader)
 	chunkFile.Close() // Close the file handle immediately after copy
+	metrics.BytesReceived.Add(float64(writtenBytes))
+	writeSpan.SetAttributes(tracing.ChunkSizeKey.Int64(writtenBytes))
+	tracing.End(writeSpan, err)
 	if err != nil {
 		// Attempt to clean up the partial file
 		os.Remove(chunkPath)
@@ -1143,6 +1480,7 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	if !strings.EqualFold(serverHashHex, clientHash) {
 		// Hashes don't match, delete the invalid chunk file
 		os.Remove(chunkPath)
+		metrics.ChunkHashMismatches.Inc()
 		LogError(nil, "Chunk hash mismatch", map[string]interface{}{
 			"file_id":     fileID,
 			"chunk":       chunkIndex,
@@ -1159,11 +1497,9 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 	// NOTE: The code below that previously read and wrote the chunk is now removed,
 	// as it was handled above with io.Copy and TeeReader.
 
-	// If this is the first chunk, store metadata about the file
+	// The first chunk also carries the upload metadata
+	var updateSession func(*models.UploadSession)
 	if chunkIndex == 0 {
-		// Store the filename, total chunks, and file size for later use
-		metadataPath := filepath.Join(chunksDir, "metadata.json")
-
 		// Check if encrypted
 		isEncrypted := r.FormValue("encrypted") == "true"
 
@@ -1186,46 +1522,30 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		metadata := map[string]interface{}{
-			"filename":     handler.Filename,
-			"total_chunks": totalChunks,
-			"file_size":    fileSize,
-			"content_type": handler.Header.Get("Content-Type"),
-			"is_encrypted": isEncrypted,
-			"expiry":       r.FormValue("expiry"),
-			"upload_time":  time.Now().Format(time.RFC3339),
-		}
-
-		// Store encrypted sample if provided
-		if len(encryptedSample) > 0 {
-			// Save sample to a separate file
-			samplePath := filepath.Join(chunksDir, "encrypted_sample")
-			if err := os.WriteFile(samplePath, encryptedSample, 0644); err != nil {
-				LogError(err, "Error writing encrypted sample to disk", map[string]interface{}{
-					"file_id":     fileID,
-					"sample_size": len(encryptedSample),
-				})
-				// Continue without saving sample, not critical
-			}
-		}
-
-		metadataJSON, err := json.Marshal(metadata)
-		if err != nil {
-			LogError(err, "Error marshaling metadata", map[string]interface{}{
-				"file_id": fileID,
-			})
-			jsonError(w, "Server error storing metadata", http.StatusInternalServerError)
-			return
+		updateSession = func(session *models.UploadSession) {
+			session.Filename = handler.Filename
+			session.FileSize = fileSize
+			session.ContentType = handler.Header.Get("Content-Type")
+			session.IsEncrypted = isEncrypted
+			session.EncryptedSample = encryptedSample
+			session.Expiry = r.FormValue("expiry")
+			session.MaxDownloads = r.FormValue("max_downloads")
 		}
+	}
 
-		if err := os.WriteFile(metadataPath, metadataJSON, 0644); err != nil {
-			LogError(err, "Error writing metadata to disk", map[string]interface{}{
-				"file_id":       fileID,
-				"metadata_path": metadataPath,
-			})
-			jsonError(w, "Server error storing metadata", http.StatusInternalServerError)
+	// Record the verified chunk so the upload can be resumed after a restart
+	if err := h.recordChunk(fileID, chunkIndex, serverHashHex, updateSession); err != nil {
+		os.Remove(chunkPath)
+		if err == storage.ErrNotFound {
+			jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
 			return
 		}
+		LogError(err, "Error recording received chunk", map[string]interface{}{
+			"file_id": fileID,
+			"chunk":   chunkIndex,
+		})
+		jsonError(w, "Server error storing upload state", http.StatusInternalServerError)
+		return
 	}
 
 	LogInfo("Chunk uploaded successfully", map[string]interface{}{
@@ -1241,6 +1561,9 @@ func (h *Handler) ChunkUpload(w http.ResponseWriter, r *http.Request) {
 		"chunk_index": chunkIndex,
 	}
 	// Add appropriate token(s) to response
+	if chunkIndex == 0 {
+		respData["resume_token"] = resumeToken
+	}
 	if chunkIndex == 0 && len(initialTokens) > 0 {
 		respData["initial_chunk_tokens"] = initialTokens
 	} else if len(nextTokens) > 0 { // Check the slice for subsequent chunks
@@ -1264,15 +1587,24 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// --- Handle Empty File Finalization ---
-	h.chunkStatesMu.Lock()
-	state, exists := h.chunkStates[fileID]
-	if exists && state.IsEmptyFile {
+	h.sessionsMu.Lock()
+	state, err := h.Storage.GetUploadSession(fileID)
+	if err != nil {
+		h.sessionsMu.Unlock()
+		if err != storage.ErrNotFound {
+			LogError(err, "Error loading upload session", map[string]interface{}{"file_id": fileID})
+		}
+		LogInfo("Chunk state not found during finalize", map[string]interface{}{"file_id": fileID})
+		jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
+		return
+	}
+	if state.IsEmptyFile {
 		LogInfo("Finalizing empty file upload", map[string]interface{}{"file_id": fileID})
 		emptyMetadata := state.FileMetadata // Get stored metadata
 		// It's crucial that emptyMetadata was correctly populated in ChunkUpload
 		if emptyMetadata == nil {
-			delete(h.chunkStates, fileID) // Clean up state
-			h.chunkStatesMu.Unlock()
+			h.deleteUploadSession(fileID) // Clean up state
+			h.sessionsMu.Unlock()
 			LogError(nil, "Internal error: Missing metadata for empty file finalization", map[string]interface{}{"file_id": fileID})
 			jsonError(w, "Internal server error during empty file finalization", http.StatusInternalServerError)
 			return
@@ -1280,10 +1612,19 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 
 		// No token validation needed for empty file
 
+		// Generate the owner's delete token
+		deleteToken, err := newDeleteToken(emptyMetadata)
+		if err != nil {
+			h.deleteUploadSession(fileID)
+			h.sessionsMu.Unlock()
+			LogError(err, "Failed to generate delete token", map[string]interface{}{"file_id": fileID})
+			jsonError(w, "Internal server error during empty file finalization", http.StatusInternalServerError)
+			return
+		}
+
 		// "Save" the empty file to storage
-		if err := h.Storage.SaveFile(emptyMetadata, bytes.NewReader(nil)); err != nil {
-			delete(h.chunkStates, fileID) // Clean up state even on error
-			h.chunkStatesMu.Unlock()
+		if err := h.Storage.SaveFile(r.Context(), emptyMetadata, bytes.NewReader(nil)); err != nil {
+			h.sessionsMu.Unlock() // Keep the session so finalize can be retried
 			LogError(err, "Error saving empty file to storage", map[string]interface{}{
 				"file_id": emptyMetadata.ID,
 			})
@@ -1292,78 +1633,33 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Success - clean up state and respond
-		delete(h.chunkStates, fileID)
-		h.chunkStatesMu.Unlock()
+		h.deleteUploadSession(fileID)
+		h.sessionsMu.Unlock()
 
+		metrics.RecordUpload(metrics.UploadChunked, 0)
 		LogInfo("Empty file finalized successfully", map[string]interface{}{
 			"filename":  emptyMetadata.Filename,
 			"file_id":   emptyMetadata.ID,
 			"mime_type": emptyMetadata.MimeType, // Should be default
 		})
 
+		setDeleteTokenFlash(w, emptyMetadata.ID, deleteToken)
 		previewURL := fmt.Sprintf("%s/file/%s", h.getBaseURL(r), emptyMetadata.ID)
 		jsonResponse(w, map[string]interface{}{
 			"status":       "success",
 			"file_id":      emptyMetadata.ID,
 			"redirect_url": previewURL,
+			"delete_token": deleteToken,
 		})
 		return // Finalization complete for empty file
 	}
-	// If not empty or state doesn't exist, continue normal finalize flow...
-	// Release lock if we didn't return early
-	if exists { // Only unlock if we held it and didn't return
-		h.chunkStatesMu.Unlock()
-	} else {
-		// State didn't exist, log and error out
-		h.chunkStatesMu.Unlock() // Must unlock even if state wasn't found
-		LogInfo("Chunk state not found during finalize (non-empty path)", map[string]interface{}{"file_id": fileID})
-		jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
-		return
-	}
+	// Not an empty file, continue normal finalize flow...
+	h.sessionsMu.Unlock()
 	// --- End Empty File Finalization ---
 
-	// Get chunks directory (Normal path continues here)
-	chunksDir := filepath.Join(os.TempDir(), "uploadfish", "chunks", fileID)
-	if _, err := os.Stat(chunksDir); os.IsNotExist(err) {
-		LogError(err, "Chunks directory not found", map[string]interface{}{
-			"file_id":    fileID,
-			"chunks_dir": chunksDir,
-		})
-		jsonError(w, "No chunks found for this file ID", http.StatusBadRequest)
-		return
-	}
-
-	// Read metadata file
-	metadataPath := filepath.Join(chunksDir, "metadata.json")
-	metadataBytes, err := os.ReadFile(metadataPath)
-	if err != nil {
-		LogError(err, "Error reading metadata file", map[string]interface{}{
-			"file_id":       fileID,
-			"metadata_path": metadataPath,
-		})
-		jsonError(w, "Error reading upload metadata", http.StatusInternalServerError)
-		return
-	}
-
-	// Parse metadata
-	var metadata map[string]interface{}
-	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
-		LogError(err, "Error parsing metadata", map[string]interface{}{
-			"file_id": fileID,
-		})
-		jsonError(w, "Error parsing upload metadata", http.StatusInternalServerError)
-		return
-	}
-
-	// Extract required metadata
-	filename, _ := metadata["filename"].(string)
-	totalChunksFloat, _ := metadata["total_chunks"].(float64)
-	totalChunks := int(totalChunksFloat)
-	fileSizeFloat, _ := metadata["file_size"].(float64)
-	fileSize := int64(fileSizeFloat)
-	contentType, _ := metadata["content_type"].(string)
-	isEncryptedValue, _ := metadata["is_encrypted"].(bool)
-	expiryValueRaw, _ := metadata["expiry"].(string)
+	// Extract required metadata from the session
+	totalChunks := state.TotalChunks
+	contentType := state.ContentType
 
 	// Validate content type if available
 	if contentType != "" {
@@ -1378,50 +1674,75 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// --- Validate Final Chunk Token ---
-	h.chunkStatesMu.Lock() // Lock before accessing shared state
-
-	state, exists = h.chunkStates[fileID] // Re-fetch state under lock
-	if !exists {
-		h.chunkStatesMu.Unlock()
-		LogInfo("Chunk state not found during finalize token check", map[string]interface{}{"file_id": fileID})
-		jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
-		return
-	}
-
 	// Get the final token from the header
 	finalChunkToken := r.Header.Get(ChunkTokenHeaderName) // Use constant
 
-	// Validate token using the total chunks from metadata
+	// Validate token using the total chunks from the session
 	// Note: If totalChunks calculation client-side was off, this could fail.
 	expectedToken := utils.GenerateHMAC(state.UploadSecret, fmt.Sprintf("chunk%d", totalChunks))
 	if finalChunkToken != expectedToken {
-		// Keep state for potential retries? Or delete? For now, delete.
-		delete(h.chunkStates, fileID)
-		h.chunkStatesMu.Unlock()
+		// Keep the session so a valid client can still resume and finalize
 		LogInfo("Final chunk token validation failed (Token mismatch)", map[string]interface{}{
 			"file_id":        fileID,
 			"final_token_ok": false,
 			"expected_index": totalChunks, // Index used for token calculation
-			// "actual_next_index": state.NextIndex, // Removed next_index logging
 		})
 		jsonError(w, fmt.Sprintf("Invalid finalization token (expected %d chunks).", totalChunks), http.StatusForbidden)
 		return
 	}
-	// Validation passed, remove the state entry
-	delete(h.chunkStates, fileID)
-	h.chunkStatesMu.Unlock() // Unlock after accessing shared state
+
+	// Only one finalize may proceed; the session is kept until the file is
+	// saved so a failed finalize can be retried
+	if !h.lockUpload(fileID) {
+		jsonError(w, "This upload is already being finalized.", http.StatusConflict)
+		return
+	}
+	defer h.unlockUpload(fileID)
+
+	h.sessionsMu.Lock() // Re-fetch under lock to see every recorded chunk
+	state, err = h.Storage.GetUploadSession(fileID)
+	if err == nil {
+		err = h.dropMissingChunks(state)
+	}
+	if err != nil {
+		h.sessionsMu.Unlock()
+		if err != storage.ErrNotFound {
+			LogError(err, "Error checking upload session during finalize", map[string]interface{}{"file_id": fileID})
+		}
+		LogInfo("Chunk state not found during finalize token check", map[string]interface{}{"file_id": fileID})
+		jsonError(w, "Invalid upload state or file ID.", http.StatusBadRequest)
+		return
+	}
+	h.sessionsMu.Unlock()
+
+	// Every chunk must have been received, verified and still be on disk
+	if missing := state.MissingChunks(); len(missing) > 0 {
+		LogInfo("Finalize requested with chunks missing", map[string]interface{}{
+			"file_id":        fileID,
+			"missing_chunks": len(missing),
+		})
+		jsonError(w, fmt.Sprintf("Upload incomplete: %d of %d chunks missing.", len(missing), totalChunks), http.StatusBadRequest)
+		return
+	}
+
 	LogInfo("Final chunk token validated, proceeding with finalize", map[string]interface{}{
 		"file_id": fileID,
 	})
 	// ------------------------------------
 
+	// Trace assembling the chunks into the stored file, including SaveFile
+	ctx, assembleSpan := tracing.Start(r.Context(), "upload.assemble",
+		tracing.FileIDKey.String(fileID), attribute.Int("uploadfish.chunk.count", totalChunks))
+	var assembleErr error
+	defer func() { tracing.End(assembleSpan, assembleErr) }()
+
 	// Prepare to open chunks for streaming
 	var chunkFiles []*os.File
 	var chunkReaders []io.Reader // Restore chunkReaders slice
 
 	// Open all chunk files
 	for i := 0; i < totalChunks; i++ {
-		chunkPath := filepath.Join(chunksDir, fmt.Sprintf("chunk_%d", i))
+		chunkPath := h.chunkPath(fileID, i)
 		file, err := os.Open(chunkPath)
 		if err != nil {
 			// <<< FIX: Clean up already opened files >>>
@@ -1429,6 +1750,7 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 				_ = openedFile.Close() // Attempt to close previously opened files
 			}
 			// <<< END FIX >>>
+			assembleErr = err
 			LogError(err, "Error opening chunk file for streaming", map[string]interface{}{
 				"file_id":    fileID,
 				"chunk":      i,
@@ -1451,41 +1773,20 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	// Create a MultiReader to stream from all chunks sequentially
 	multiReader := io.MultiReader(chunkReaders...) // Pass chunkReaders slice
 
-	// Parse expiry option using helper
-	expiryTime, expiryValueValidated := parseAndValidateExpiry(expiryValueRaw)
+	// Create the file metadata from the upload session
+	fileMetadata := h.newFileFromSession(r, state, contentType)
 
-	// Check for encrypted sample if the file is encrypted
-	var encryptedSample []byte
-	if isEncryptedValue {
-		samplePath := filepath.Join(chunksDir, "encrypted_sample")
-		if sampleData, err := os.ReadFile(samplePath); err == nil {
-			encryptedSample = sampleData
-			LogInfo("Retrieved encrypted sample from chunked upload", map[string]interface{}{
-				"file_id":     fileID,
-				"sample_size": len(encryptedSample),
-			})
-		} else {
-			LogError(err, "No encrypted sample found, continuing without", map[string]interface{}{
-				"file_id": fileID,
-			})
-		}
-	}
-
-	// Create the file metadata
-	fileMetadata := &models.File{
-		ID:              fileID,
-		Filename:        sanitizeFilename(filename),
-		MimeType:        contentType,
-		Size:            fileSize,
-		UploadTime:      time.Now(),           // Consider using upload_time from metadata?
-		ExpiryValue:     expiryValueValidated, // Store validated value
-		ExpiryTime:      expiryTime,           // Store calculated time (or zero)
-		IsEncrypted:     isEncryptedValue,
-		EncryptedSample: encryptedSample,
+	// Generate the owner's delete token
+	deleteToken, err := newDeleteToken(fileMetadata)
+	if err != nil {
+		LogError(err, "Failed to generate delete token", map[string]interface{}{"file_id": fileID})
+		jsonError(w, "Server error finalizing upload", http.StatusInternalServerError)
+		return
 	}
 
 	// Save to storage using the MultiReader for content
-	if err := h.Storage.SaveFile(fileMetadata, multiReader); err != nil {
+	if err := h.Storage.SaveFile(ctx, fileMetadata, multiReader); err != nil {
+		assembleErr = err
 		LogError(err, "Error saving file via streaming", map[string]interface{}{
 			"file_id":   fileMetadata.ID,
 			"file_size": fileMetadata.Size,
@@ -1494,6 +1795,12 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The file is stored, so the session and its chunks are no longer needed
+	h.sessionsMu.Lock()
+	h.deleteUploadSession(fileID)
+	h.sessionsMu.Unlock()
+
+	metrics.RecordUpload(metrics.UploadChunked, fileMetadata.Size)
 	LogInfo("File upload finalized successfully", map[string]interface{}{
 		"filename":  fileMetadata.Filename,
 		"size":      fileMetadata.Size,
@@ -1502,6 +1809,7 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// Clean up chunks directory synchronously
+	chunksDir := h.chunksDirFor(fileID)
 	if err := os.RemoveAll(chunksDir); err != nil {
 		LogError(err, "Error cleaning up chunks directory", map[string]interface{}{
 			"file_id":    fileID,
@@ -1509,15 +1817,63 @@ func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	// Return success with redirect URL
+	// Return success with redirect URL and the owner's delete token, which the
+	// preview page also shows once
+	setDeleteTokenFlash(w, fileMetadata.ID, deleteToken)
 	previewURL := fmt.Sprintf("%s/file/%s", h.getBaseURL(r), fileMetadata.ID)
 	jsonResponse(w, map[string]interface{}{
 		"status":       "success",
 		"file_id":      fileID,
 		"redirect_url": previewURL,
+		"delete_token": deleteToken,
 	})
 }
 
+// newFileFromSession builds the metadata for a finished upload from the
+// options recorded in its session
+func (h *Handler) newFileFromSession(r *http.Request, session *models.UploadSession, mimeType string) *models.File {
+	// Parse expiry option using helper
+	expiryTime, expiryValueValidated := h.parseAndValidateExpiry(r, session.Expiry)
+	maxDownloads := h.parseMaxDownloads(session.MaxDownloads, expiryValueValidated)
+
+	// Use the encrypted sample sent with the upload, if any
+	var encryptedSample []byte
+	if session.IsEncrypted {
+		if len(session.EncryptedSample) > 0 {
+			encryptedSample = session.EncryptedSample
+			LogInfo("Retrieved encrypted sample from upload session", map[string]interface{}{
+				"file_id":     session.ID,
+				"sample_size": len(encryptedSample),
+			})
+		} else {
+			LogInfo("No encrypted sample found, continuing without", map[string]interface{}{
+				"file_id": session.ID,
+			})
+		}
+	}
+
+	return &models.File{
+		ID:                 session.ID,
+		Filename:           sanitizeFilename(session.Filename),
+		MimeType:           mimeType,
+		Size:               session.FileSize,
+		UploadTime:         time.Now(),
+		ExpiryValue:        expiryValueValidated, // Store validated value
+		ExpiryTime:         expiryTime,           // Store calculated time (or zero)
+		IsEncrypted:        session.IsEncrypted,
+		EncryptedSample:    encryptedSample,
+		MaxDownloads:       maxDownloads,
+		DownloadsRemaining: maxDownloads,
+	}
+}
+
+// deleteUploadSession removes a finished or failed upload session, logging failures
+func (h *Handler) deleteUploadSession(fileID string) {
+	if err := h.Storage.DeleteUploadSession(fileID); err != nil {
+		LogError(err, "Error deleting upload session", map[string]interface{}{"file_id": fileID})
+	}
+}
+
 // Helper function to return JSON error responses
 func jsonError(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
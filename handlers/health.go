@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"uploadfish/storage"
+	"uploadfish/utils"
+)
+
+// ReadinessTimeout bounds how long a readiness check waits for the database
+const ReadinessTimeout = 2 * time.Second
+
+// HealthStatus is the response body of /livez and /readyz
+type HealthStatus struct {
+	Status string `json:"status"`
+	// Checks maps each readiness check to "ok" or the reason it failed
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Livez handles GET /livez. The process is alive if it can serve a request,
+// so it never checks dependencies; a failing dependency should take the
+// server out of rotation through /readyz, not get it restarted.
+func (h *Handler) Livez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// Readyz handles GET /readyz, reporting whether the server should be sent
+// traffic: the database responds, the chunk directory can be written, there is
+// enough free disk space and the server isn't draining for shutdown
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"database":   h.checkDatabase(),
+		"chunk_dir":  h.checkChunkDirWritable(),
+		"disk_space": h.checkDiskSpace(),
+		"draining":   nil,
+	}
+	if h.Draining() {
+		checks["draining"] = fmt.Errorf("server is shutting down")
+	}
+
+	status := HealthStatus{Status: "ok", Checks: make(map[string]string, len(checks))}
+	code := http.StatusOK
+	for name, err := range checks {
+		if err == nil {
+			status.Checks[name] = "ok"
+			continue
+		}
+		status.Checks[name] = err.Error()
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	if code != http.StatusOK {
+		LogInfo("Readiness check failed", map[string]interface{}{
+			"checks": status.Checks,
+		})
+	}
+	writeHealth(w, code, status)
+}
+
+// checkDatabase pings the database, giving up after ReadinessTimeout so a
+// stuck database fails the check instead of hanging the probe
+func (h *Handler) checkDatabase() error {
+	result := make(chan error, 1)
+	go func() {
+		result <- h.Storage.Ping()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(ReadinessTimeout):
+		return fmt.Errorf("database did not respond within %s", ReadinessTimeout)
+	}
+}
+
+// checkChunkDirWritable creates and removes a file in the chunk directory
+func (h *Handler) checkChunkDirWritable() error {
+	if err := os.MkdirAll(h.chunksRoot(), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(h.chunksRoot(), ".readyz-*")
+	if err != nil {
+		return err
+	}
+	_, writeErr := file.Write([]byte("ok"))
+	closeErr := file.Close()
+	removeErr := os.Remove(file.Name())
+	for _, err := range []error{writeErr, closeErr, removeErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDiskSpace checks that the filesystems holding the database, the chunk
+// directory and filesystem content have at least MinFreeDiskSpace available
+func (h *Handler) checkDiskSpace() error {
+	if h.Config.MinFreeDiskSpace <= 0 {
+		return nil
+	}
+
+	paths := []string{h.Config.BitcaskPath, h.chunksRoot()}
+	if h.Config.StorageBackend == storage.BackendFilesystem {
+		paths = append(paths, h.Config.ContentPath)
+	}
+	for _, path := range paths {
+		free, err := utils.FreeDiskSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < uint64(h.Config.MinFreeDiskSpace) {
+			return fmt.Errorf("%s has %d bytes free, below the minimum of %d", path, free, h.Config.MinFreeDiskSpace)
+		}
+	}
+	return nil
+}
+
+// writeHealth writes a health response that is never cached
+func writeHealth(w http.ResponseWriter, status int, body HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		LogError(err, "Error encoding health response", nil)
+	}
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"uploadfish/metrics"
+	"uploadfish/models"
+	"uploadfish/utils"
+)
+
+// Request headers carrying the upload options for raw uploads, so that
+// `curl -T file https://host/` works without a form or CSRF cookie
+const (
+	FilenameHeaderName        = "X-Filename"
+	ExpiryHeaderName          = "X-Expiry"
+	MaxDownloadsHeaderName    = "X-Max-Downloads"
+	EncryptedHeaderName       = "X-Encrypted"
+	EncryptedSampleHeaderName = "X-Encrypted-Sample"
+)
+
+// CreateFileRequest holds the options for an upload whose content is the
+// request body
+type CreateFileRequest struct {
+	Filename        string
+	Expiry          string
+	MaxDownloads    int
+	IsEncrypted     bool
+	EncryptedSample []byte
+}
+
+// uploadError describes why a streamed upload was rejected
+type uploadError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// RawUpload handles PUT /{filename} and POST / with the file as the raw
+// request body. The body is streamed straight into storage without being
+// spooled to disk, and the share URL is returned as plain text.
+func (h *Handler) RawUpload(w http.ResponseWriter, r *http.Request) {
+	req, err := parseRawUploadHeaders(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileMetadata, deleteToken, uploadErr := h.saveStreamedUpload(w, r, req)
+	if uploadErr != nil {
+		http.Error(w, uploadErr.Message, uploadErr.Status)
+		return
+	}
+
+	fileURL := fmt.Sprintf("%s/file/%s", h.getBaseURL(r), fileMetadata.ID)
+	w.Header().Set("Location", fileURL)
+	w.Header().Set(DeleteTokenHeaderName, deleteToken)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, fileURL)
+}
+
+// parseRawUploadHeaders reads the upload options of a raw upload. The
+// filename comes from the path for PUT and from a header for POST.
+func parseRawUploadHeaders(r *http.Request) (CreateFileRequest, error) {
+	req := CreateFileRequest{
+		Filename:    r.Header.Get(FilenameHeaderName),
+		Expiry:      strings.TrimSpace(r.Header.Get(ExpiryHeaderName)),
+		IsEncrypted: strings.EqualFold(r.Header.Get(EncryptedHeaderName), "true"),
+	}
+	if param := chi.URLParam(r, "filename"); param != "" {
+		if unescaped, err := url.PathUnescape(param); err == nil {
+			req.Filename = unescaped
+		} else {
+			req.Filename = param
+		}
+	}
+
+	if value := strings.TrimSpace(r.Header.Get(MaxDownloadsHeaderName)); value != "" {
+		maxDownloads, err := strconv.Atoi(value)
+		if err != nil || maxDownloads < 0 {
+			return req, fmt.Errorf("invalid %s header", MaxDownloadsHeaderName)
+		}
+		req.MaxDownloads = maxDownloads
+	}
+
+	if sampleBase64 := r.Header.Get(EncryptedSampleHeaderName); req.IsEncrypted && sampleBase64 != "" {
+		sample, err := utils.Base64Decode(sampleBase64)
+		if err != nil {
+			return req, fmt.Errorf("invalid %s header", EncryptedSampleHeaderName)
+		}
+		req.EncryptedSample = sample
+	}
+
+	return req, nil
+}
+
+// saveStreamedUpload streams the request body into storage as a new file,
+// detecting its content type from the first bytes. It returns the saved
+// metadata and the owner's delete token.
+func (h *Handler) saveStreamedUpload(w http.ResponseWriter, r *http.Request, req CreateFileRequest) (*models.File, string, *uploadError) {
+	if h.refuseNewUpload(w, r) {
+		return nil, "", &uploadError{Status: http.StatusServiceUnavailable, Code: APIErrorUnavailable, Message: DrainingMessage}
+	}
+
+	maxUploadSize := h.maxUploadSize(r)
+	tooBig := &uploadError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    APIErrorFileTooLarge,
+		Message: fmt.Sprintf("File is too big, the maximum size is %d MB", maxUploadSize/(1<<20)),
+	}
+
+	// Reject uploads that announce a size over the limit before reading anything
+	if r.ContentLength > maxUploadSize {
+		return nil, "", tooBig
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	// Detect the content type from the start of the body
+	body := bufio.NewReaderSize(r.Body, 512)
+	header, err := body.Peek(512)
+	if err != nil && err != io.EOF {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, "", tooBig
+		}
+		LogError(err, "Error reading upload body", nil)
+		return nil, "", &uploadError{Status: http.StatusBadRequest, Code: APIErrorBadRequest, Message: "Error reading request body"}
+	}
+	contentType := http.DetectContentType(header)
+	if err := validateContentType(contentType, h.Config.AllowedTypes); err != nil {
+		return nil, "", &uploadError{Status: http.StatusUnsupportedMediaType, Code: APIErrorUnsupportedType, Message: err.Error()}
+	}
+
+	fileMetadata := h.newFileFromRequest(r, req, contentType)
+
+	// Generate the owner's delete token
+	deleteToken, err := newDeleteToken(fileMetadata)
+	if err != nil {
+		LogError(err, "Failed to generate delete token", nil)
+		return nil, "", &uploadError{Status: http.StatusInternalServerError, Code: APIErrorInternal, Message: "Server error preparing upload"}
+	}
+
+	// Save to storage; the stored size is the number of bytes read
+	if err := h.Storage.SaveFile(r.Context(), fileMetadata, body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, "", tooBig
+		}
+		LogError(err, "Error saving streamed upload", map[string]interface{}{
+			"file_id": fileMetadata.ID,
+		})
+		return nil, "", &uploadError{Status: http.StatusInternalServerError, Code: APIErrorInternal, Message: "Error saving file"}
+	}
+
+	metrics.BytesReceived.Add(float64(fileMetadata.Size))
+	metrics.RecordUpload(metrics.UploadSingle, fileMetadata.Size)
+	LogInfo("Streamed upload saved successfully", map[string]interface{}{
+		"filename":  fileMetadata.Filename,
+		"size":      fileMetadata.Size,
+		"mime_type": fileMetadata.MimeType,
+		"file_id":   fileMetadata.ID,
+	})
+
+	return fileMetadata, deleteToken, nil
+}
+
+// newFileFromRequest builds the metadata for a streamed upload
+func (h *Handler) newFileFromRequest(r *http.Request, req CreateFileRequest, contentType string) *models.File {
+	// Parse expiry option using helper
+	expiryTime, expiryValueValidated := h.parseAndValidateExpiry(r, req.Expiry)
+	maxDownloads := h.limitMaxDownloads(req.MaxDownloads, expiryValueValidated)
+
+	var encryptedSample []byte
+	if req.IsEncrypted {
+		encryptedSample = req.EncryptedSample
+	}
+
+	return &models.File{
+		ID:                 uuid.New().String(),
+		Filename:           sanitizeFilename(req.Filename),
+		MimeType:           contentType,
+		UploadTime:         time.Now(),
+		ExpiryValue:        expiryValueValidated, // Store validated value
+		ExpiryTime:         expiryTime,           // Store calculated time (or zero)
+		IsEncrypted:        req.IsEncrypted,
+		EncryptedSample:    encryptedSample,
+		MaxDownloads:       maxDownloads,
+		DownloadsRemaining: maxDownloads,
+	}
+}
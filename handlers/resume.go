@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+
+	"uploadfish/storage"
+	"uploadfish/utils"
+)
+
+// uploadResumeToken derives the token that lets a client query the status of
+// its chunked upload. It is returned with the first chunk's response.
+func uploadResumeToken(uploadSecret string) string {
+	return utils.GenerateHMAC(uploadSecret, "resume")
+}
+
+// UploadStatus handles GET /upload/{fileID}/status. It reports which chunks
+// the server has received, hash-verified and still has on disk, with their
+// SHA-256 hashes so the client can check it is resuming the same content, and
+// returns fresh chunk tokens for the missing ones so an interrupted upload can
+// continue where it left off. The resume token from the first chunk's response
+// must be sent in the X-Resume-Token header. If chunk 0 is missing the upload
+// must start over.
+func (h *Handler) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	fileID := chi.URLParam(r, "fileID")
+
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	session, err := h.Storage.GetUploadSession(fileID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			LogError(err, "Error loading upload session", map[string]interface{}{"file_id": fileID})
+		}
+		jsonError(w, "Invalid upload state or file ID.", http.StatusNotFound)
+		return
+	}
+
+	resumeToken := r.Header.Get(ResumeTokenHeaderName)
+	expected := uploadResumeToken(session.UploadSecret)
+	if subtle.ConstantTimeCompare([]byte(resumeToken), []byte(expected)) != 1 {
+		LogInfo("Invalid resume token for upload status", map[string]interface{}{
+			"file_id": fileID,
+			"ip":      r.RemoteAddr,
+		})
+		jsonError(w, "Invalid resume token.", http.StatusForbidden)
+		return
+	}
+
+	// Chunks whose files were lost are reported as missing so they are sent again
+	if err := h.dropMissingChunks(session); err != nil {
+		LogError(err, "Error checking received chunks", map[string]interface{}{"file_id": fileID})
+		jsonError(w, "Server error checking upload state", http.StatusInternalServerError)
+		return
+	}
+
+	// Tokens for the missing chunks, keyed by chunk index. Chunk 0 never
+	// needs a token.
+	missing := session.MissingChunks()
+	chunkTokens := make(map[string]string, len(missing))
+	for _, index := range missing {
+		if index > 0 {
+			chunkTokens[strconv.Itoa(index)] = utils.GenerateHMAC(session.UploadSecret, fmt.Sprintf("chunk%d", index))
+		}
+	}
+
+	chunkHashes := make(map[string]string, len(session.ReceivedChunks))
+	for index, hash := range session.ReceivedChunks {
+		chunkHashes[strconv.Itoa(index)] = hash
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"status":          "success",
+		"file_id":         session.ID,
+		"file_size":       session.FileSize,
+		"total_chunks":    session.TotalChunks,
+		"received_chunks": session.ReceivedChunkIndices(),
+		"missing_chunks":  missing,
+		"chunk_hashes":    chunkHashes,
+		"chunk_tokens":    chunkTokens,
+		"finalize_token":  utils.GenerateHMAC(session.UploadSecret, fmt.Sprintf("chunk%d", session.TotalChunks)),
+	})
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"uploadfish/config"
+	"uploadfish/middleware"
+	"uploadfish/models"
+	"uploadfish/storage"
+	"uploadfish/tracing"
+	"uploadfish/utils"
+)
+
+// otlpReceiver is an in-process stand-in for an OTLP/HTTP trace collector
+type otlpReceiver struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (o *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	o.mu.Lock()
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			o.spans = append(o.spans, scopeSpans.Spans...)
+		}
+	}
+	o.mu.Unlock()
+
+	response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(response)
+}
+
+// requestIDs returns the http.request.id attribute of each received span
+// with the given name
+func (o *otlpReceiver) requestIDs(name string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var ids []string
+	for _, span := range o.spans {
+		if span.Name != name {
+			continue
+		}
+		for _, attr := range span.Attributes {
+			if attr.Key == string(tracing.RequestIDKey) {
+				ids = append(ids, attr.Value.GetStringValue())
+			}
+		}
+	}
+	return ids
+}
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Error(err error, message string, fields map[string]interface{}) {
+	l.t.Logf("%s: %v %v", message, err, fields)
+}
+
+func (l testLogger) Info(message string, fields map[string]interface{}) {}
+
+// newTestHandler builds a handler over a fresh database without templates
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg := config.Default()
+	cfg.BitcaskPath = t.TempDir()
+	cfg.ChunkPath = t.TempDir()
+	store, err := storage.New(ctx, cfg, testLogger{t})
+	if err != nil {
+		t.Fatalf("storage.New: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	expiry, err := models.NewExpiryPolicy(cfg.ExpiryOptions, cfg.DefaultExpiry, cfg.MaxRetention)
+	if err != nil {
+		t.Fatalf("NewExpiryPolicy: %v", err)
+	}
+
+	return &Handler{
+		Config:         cfg,
+		Storage:        store,
+		Expiry:         expiry,
+		csrfProtection: utils.NewCSRFProtection(ctx, cfg.CSRFExpiration, testLogger{t}),
+		lockedUploads:  make(map[string]bool),
+	}
+}
+
+// postForm sends a multipart form with a CSRF token and request ID, decoding
+// the JSON response
+func postForm(t *testing.T, server *httptest.Server, h *Handler, path, requestID string, fields map[string]string, file []byte, headers map[string]string) map[string]interface{} {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if file != nil {
+		part, _ := form.CreateFormFile("file", "chunk")
+		part.Write(file)
+	}
+	form.Close()
+
+	tokens := h.csrfProtection.GenerateTokenPair()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set(CSRFHeaderName, tokens.FormToken)
+	req.Header.Set("X-Request-ID", requestID)
+	req.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: tokens.CookieToken})
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding %s response: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s: status %d: %v", path, resp.StatusCode, result)
+	}
+	return result
+}
+
+func TestChunkedUploadSpansExported(t *testing.T) {
+	receiver := &otlpReceiver{}
+	collector := httptest.NewServer(receiver)
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	shutdown, err := tracing.Setup(context.Background())
+	if err != nil {
+		t.Fatalf("tracing.Setup: %v", err)
+	}
+
+	h := newTestHandler(t)
+	router := chi.NewRouter()
+	router.Use(middleware.RequestIDMiddleware)
+	router.Use(middleware.TracingMiddleware)
+	router.Post("/upload/chunk", h.ChunkUpload)
+	router.Post("/upload/finalize", h.FinalizeUpload)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	content := []byte("traced upload content")
+	hash := sha256.Sum256(content)
+	fileID := "0b6c3d9e-1f2a-4b5c-8d7e-9f0a1b2c3d4e"
+
+	chunk := postForm(t, server, h, "/upload/chunk", "req-chunk", map[string]string{
+		"file_id":      fileID,
+		"chunk_index":  "0",
+		"total_chunks": "1",
+		"file_size":    "21",
+		"chunk_hash":   hex.EncodeToString(hash[:]),
+		"filename":     "traced.txt",
+		"content_type": "text/plain",
+	}, content, nil)
+	tokens, _ := chunk["initial_chunk_tokens"].([]interface{})
+	if len(tokens) != 1 {
+		t.Fatalf("chunk response has no finalize token: %v", chunk)
+	}
+
+	postForm(t, server, h, "/upload/finalize", "req-finalize", map[string]string{
+		"file_id": fileID,
+	}, nil, map[string]string{ChunkTokenHeaderName: tokens[0].(string)})
+
+	// Shutting down flushes the batched spans to the receiver
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("flushing spans: %v", err)
+	}
+
+	for _, want := range []struct {
+		span      string
+		requestID string
+	}{
+		{"HTTP POST /upload/chunk", "req-chunk"},
+		{"upload.writeChunk", "req-chunk"},
+		{"HTTP POST /upload/finalize", "req-finalize"},
+		{"upload.assemble", "req-finalize"},
+		{"storage.SaveFile", "req-finalize"},
+	} {
+		ids := receiver.requestIDs(want.span)
+		if len(ids) != 1 || ids[0] != want.requestID {
+			t.Errorf("span %q: got request IDs %v, want [%s]", want.span, ids, want.requestID)
+		}
+	}
+}
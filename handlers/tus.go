@@ -0,0 +1,499 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"uploadfish/metrics"
+	"uploadfish/models"
+	"uploadfish/storage"
+	"uploadfish/tracing"
+	"uploadfish/utils"
+)
+
+// tus resumable upload protocol, see https://tus.io/protocols/resumable-upload
+const (
+	TusVersion     = "1.0.0"
+	TusExtensions  = "creation,termination,expiration"
+	tusProtocol    = "tus"
+	tusContentType = "application/offset+octet-stream"
+	tusDataFile    = "data"
+)
+
+// tusDataPath returns the file a tus upload is written to
+func (h *Handler) tusDataPath(fileID string) string {
+	return filepath.Join(h.chunksDirFor(fileID), tusDataFile)
+}
+
+// checkTusResumable sets the Tus-Resumable response header and rejects
+// requests made with a protocol version other than the one supported
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// setTusExpires sets the Upload-Expires header for an unfinished upload.
+// Sessions not updated within ChunkStateCleanupAge are removed by the
+// upload session cleanup.
+func setTusExpires(w http.ResponseWriter, session *models.UploadSession) {
+	w.Header().Set("Upload-Expires", session.LastUpdated.Add(ChunkStateCleanupAge).UTC().Format(http.TimeFormat))
+}
+
+// parseTusMetadata parses an Upload-Metadata header: comma-separated pairs of
+// a key and an optional base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("invalid metadata pair %q", pair)
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := utils.Base64Decode(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata value for %q", parts[0])
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
+
+// lockUpload marks an upload as being modified by a tus request or a
+// finalize. Returns false if another request already holds it.
+func (h *Handler) lockUpload(fileID string) bool {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	if h.lockedUploads[fileID] {
+		return false
+	}
+	h.lockedUploads[fileID] = true
+	return true
+}
+
+// unlockUpload releases an upload locked by lockUpload
+func (h *Handler) unlockUpload(fileID string) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	delete(h.lockedUploads, fileID)
+}
+
+// getTusSession loads an unfinished tus upload, writing a 404 response if
+// there is none or it has expired
+func (h *Handler) getTusSession(w http.ResponseWriter, fileID string) (*models.UploadSession, bool) {
+	session, err := h.Storage.GetUploadSession(fileID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			LogError(err, "Error loading tus upload session", map[string]interface{}{"file_id": fileID})
+		}
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if session.Protocol != tusProtocol || time.Since(session.LastUpdated) > ChunkStateCleanupAge {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+// TusOptions handles OPTIONS /tus/ and reports the supported protocol
+func (h *Handler) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxUploadSize(r), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate handles POST /tus/ (creation extension). Upload options are read
+// from Upload-Metadata: filename, filetype, expiry, max_downloads, encrypted
+// and encrypted_sample (base64), matching the browser upload form.
+func (h *Handler) TusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if h.refuseNewUpload(w, r) {
+		http.Error(w, DrainingMessage, http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Deferred upload length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid or missing Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > h.maxUploadSize(r) {
+		http.Error(w, fmt.Sprintf("File too large. Maximum size is %d MB.", h.maxUploadSize(r)/(1<<20)), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadataHeader := r.Header.Get("Upload-Metadata")
+	metadata, err := parseTusMetadata(metadataHeader)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid Upload-Metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		filename = "file"
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = metadata["type"]
+	}
+	if contentType != "" {
+		if err := validateContentType(contentType, h.Config.AllowedTypes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	isEncrypted := metadata["encrypted"] == "true"
+	var encryptedSample []byte
+	if isEncrypted && metadata["encrypted_sample"] != "" {
+		encryptedSample, err = utils.Base64Decode(metadata["encrypted_sample"])
+		if err != nil {
+			LogError(err, "Error decoding encrypted sample", nil)
+			// Continue without sample, not critical
+			encryptedSample = nil
+		}
+	}
+
+	uploadSecret, err := utils.GenerateRandomString(32)
+	if err != nil {
+		LogError(err, "Failed to generate upload secret", nil)
+		http.Error(w, "Server error starting upload", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	session := &models.UploadSession{
+		ID:              uuid.New().String(),
+		UploadSecret:    uploadSecret,
+		Protocol:        tusProtocol,
+		CreatedAt:       now,
+		LastUpdated:     now,
+		Filename:        filename,
+		FileSize:        length,
+		ContentType:     contentType,
+		IsEncrypted:     isEncrypted,
+		EncryptedSample: encryptedSample,
+		Expiry:          metadata["expiry"],
+		MaxDownloads:    metadata["max_downloads"],
+		TusMetadata:     metadataHeader,
+	}
+
+	// Create the empty data file that PATCH requests append to
+	if err := os.MkdirAll(h.chunksDirFor(session.ID), 0755); err != nil {
+		LogError(err, "Error creating tus upload directory", map[string]interface{}{"file_id": session.ID})
+		http.Error(w, "Server error starting upload", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(h.tusDataPath(session.ID), nil, 0644); err != nil {
+		LogError(err, "Error creating tus upload file", map[string]interface{}{"file_id": session.ID})
+		http.Error(w, "Server error starting upload", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Storage.SaveUploadSession(session); err != nil {
+		_ = os.RemoveAll(h.chunksDirFor(session.ID))
+		LogError(err, "Failed to save tus upload session", map[string]interface{}{"file_id": session.ID})
+		http.Error(w, "Server error starting upload", http.StatusInternalServerError)
+		return
+	}
+
+	LogInfo("Created tus upload", map[string]interface{}{
+		"file_id": session.ID,
+		"length":  length,
+	})
+
+	w.Header().Set("Location", fmt.Sprintf("%s/tus/%s", h.getBaseURL(r), session.ID))
+
+	// An empty upload is complete as soon as it is created
+	if length == 0 {
+		if !h.finishTusUpload(w, r, session) {
+			return
+		}
+	} else {
+		setTusExpires(w, session)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead handles HEAD /tus/{fileID} and reports the upload offset
+func (h *Handler) TusHead(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	fileID := chi.URLParam(r, "fileID")
+
+	// A finished upload reports its full length so clients stop resuming
+	if _, err := h.Storage.GetUploadSession(fileID); err == storage.ErrNotFound {
+		if file, err := h.Storage.GetFile(fileID); err == nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(file.Size, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(file.Size, 10))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
+	session, ok := h.getTusSession(w, fileID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.FileSize, 10))
+	if session.TusMetadata != "" {
+		w.Header().Set("Upload-Metadata", session.TusMetadata)
+	}
+	setTusExpires(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch handles PATCH /tus/{fileID}, appending the request body at the
+// given offset. Bytes received before an interrupted request are kept. The
+// request completing the upload saves the file and returns its URL and the
+// owner's delete token in the X-File-URL and X-Delete-Token headers.
+func (h *Handler) TusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Content-Type must be "+tusContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid or missing Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	fileID := chi.URLParam(r, "fileID")
+	if !h.lockUpload(fileID) {
+		http.Error(w, "Upload is in use by another request", http.StatusLocked)
+		return
+	}
+	defer h.unlockUpload(fileID)
+
+	session, ok := h.getTusSession(w, fileID)
+	if !ok {
+		return
+	}
+	if offset != session.UploadOffset {
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	remaining := session.FileSize - session.UploadOffset
+	if r.ContentLength > remaining {
+		http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Drop anything written past the recorded offset by an earlier request
+	// that failed before its offset was saved
+	dataFile, err := os.OpenFile(h.tusDataPath(fileID), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		LogError(err, "Error opening tus upload file", map[string]interface{}{"file_id": fileID})
+		http.Error(w, "Server error writing upload", http.StatusInternalServerError)
+		return
+	}
+	if err := dataFile.Truncate(session.UploadOffset); err == nil {
+		_, err = dataFile.Seek(session.UploadOffset, io.SeekStart)
+	}
+	if err != nil {
+		_ = dataFile.Close()
+		LogError(err, "Error preparing tus upload file", map[string]interface{}{"file_id": fileID})
+		http.Error(w, "Server error writing upload", http.StatusInternalServerError)
+		return
+	}
+
+	_, writeSpan := tracing.Start(r.Context(), "upload.writeTus",
+		tracing.FileIDKey.String(fileID), attribute.Int64("uploadfish.upload.offset", session.UploadOffset))
+	written, copyErr := io.Copy(dataFile, io.LimitReader(r.Body, remaining))
+	metrics.BytesReceived.Add(float64(written))
+	writeSpan.SetAttributes(tracing.ChunkSizeKey.Int64(written))
+	tracing.End(writeSpan, copyErr)
+	if copyErr == nil && written == remaining {
+		// Reject a body longer than the upload, for chunked requests
+		// without a Content-Length
+		if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+			_ = dataFile.Truncate(session.UploadOffset)
+			_ = dataFile.Close()
+			http.Error(w, "Request body exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	syncErr := dataFile.Sync()
+	if err := dataFile.Close(); syncErr == nil {
+		syncErr = err
+	}
+	if syncErr != nil {
+		LogError(syncErr, "Error flushing tus upload file", map[string]interface{}{"file_id": fileID})
+		http.Error(w, "Server error writing upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Record the new offset, including bytes from an interrupted request.
+	// The final offset is never recorded: if finishing the upload fails, the
+	// client is told the last bytes are missing, and sending them again
+	// retries the finish.
+	session.UploadOffset += written
+	complete := session.UploadOffset == session.FileSize
+	if !complete {
+		session.LastUpdated = time.Now()
+		if err := h.Storage.SaveUploadSession(session); err != nil {
+			LogError(err, "Error saving tus upload offset", map[string]interface{}{"file_id": fileID})
+			http.Error(w, "Server error storing upload state", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if copyErr != nil {
+		LogError(copyErr, "Error reading tus upload data", map[string]interface{}{
+			"file_id": fileID,
+			"written": written,
+		})
+		http.Error(w, "Error reading upload data", http.StatusBadRequest)
+		return
+	}
+
+	if complete {
+		if !h.finishTusUpload(w, r, session) {
+			return
+		}
+	} else {
+		setTusExpires(w, session)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.UploadOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete handles DELETE /tus/{fileID} (termination extension)
+func (h *Handler) TusDelete(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+
+	fileID := chi.URLParam(r, "fileID")
+	if !h.lockUpload(fileID) {
+		http.Error(w, "Upload is in use by another request", http.StatusLocked)
+		return
+	}
+	defer h.unlockUpload(fileID)
+
+	if _, ok := h.getTusSession(w, fileID); !ok {
+		return
+	}
+
+	h.deleteUploadSession(fileID)
+	if err := os.RemoveAll(h.chunksDirFor(fileID)); err != nil {
+		LogError(err, "Error removing terminated tus upload", map[string]interface{}{"file_id": fileID})
+	}
+
+	LogInfo("Terminated tus upload", map[string]interface{}{"file_id": fileID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload saves a completely received tus upload through the same
+// path as FinalizeUpload, then removes the upload session. On success the
+// file URL and delete token headers are set and true is returned; otherwise
+// an error response has been written.
+func (h *Handler) finishTusUpload(w http.ResponseWriter, r *http.Request, session *models.UploadSession) bool {
+	dataFile, err := os.Open(h.tusDataPath(session.ID))
+	if err != nil {
+		LogError(err, "Error opening finished tus upload", map[string]interface{}{"file_id": session.ID})
+		http.Error(w, "Server error finalizing upload", http.StatusInternalServerError)
+		return false
+	}
+	defer dataFile.Close()
+
+	// Detect the content type if the client didn't send one
+	mimeType := session.ContentType
+	if mimeType == "" {
+		buffer := make([]byte, 512)
+		n, _ := io.ReadFull(dataFile, buffer)
+		mimeType = http.DetectContentType(buffer[:n])
+		if _, err := dataFile.Seek(0, io.SeekStart); err != nil {
+			LogError(err, "Error rewinding finished tus upload", map[string]interface{}{"file_id": session.ID})
+			http.Error(w, "Server error finalizing upload", http.StatusInternalServerError)
+			return false
+		}
+	}
+	if err := validateContentType(mimeType, h.Config.AllowedTypes); err != nil {
+		h.deleteUploadSession(session.ID)
+		_ = os.RemoveAll(h.chunksDirFor(session.ID))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	fileMetadata := h.newFileFromSession(r, session, mimeType)
+
+	// Generate the owner's delete token
+	deleteToken, err := newDeleteToken(fileMetadata)
+	if err != nil {
+		LogError(err, "Failed to generate delete token", map[string]interface{}{"file_id": session.ID})
+		http.Error(w, "Server error finalizing upload", http.StatusInternalServerError)
+		return false
+	}
+
+	if err := h.Storage.SaveFile(r.Context(), fileMetadata, dataFile); err != nil {
+		LogError(err, "Error saving tus upload", map[string]interface{}{
+			"file_id":   fileMetadata.ID,
+			"file_size": fileMetadata.Size,
+		})
+		http.Error(w, "Server error finalizing upload", http.StatusInternalServerError)
+		return false
+	}
+
+	h.deleteUploadSession(session.ID)
+	if err := os.RemoveAll(h.chunksDirFor(session.ID)); err != nil {
+		LogError(err, "Error cleaning up tus upload directory", map[string]interface{}{"file_id": session.ID})
+	}
+
+	metrics.RecordUpload(metrics.UploadChunked, fileMetadata.Size)
+	LogInfo("tus upload finalized successfully", map[string]interface{}{
+		"filename":  fileMetadata.Filename,
+		"size":      fileMetadata.Size,
+		"mime_type": fileMetadata.MimeType,
+		"file_id":   fileMetadata.ID,
+	})
+
+	w.Header().Set("X-File-URL", fmt.Sprintf("%s/file/%s", h.getBaseURL(r), fileMetadata.ID))
+	w.Header().Set(DeleteTokenHeaderName, deleteToken)
+	return true
+}
@@ -15,8 +15,11 @@ import (
 
 	"uploadfish/config"
 	"uploadfish/handlers"
+	"uploadfish/metrics"
 	"uploadfish/middleware"
+	"uploadfish/models"
 	"uploadfish/storage"
+	"uploadfish/tracing"
 	"uploadfish/utils"
 )
 
@@ -39,6 +42,17 @@ func (l *CSRFLogger) Info(message string, fields map[string]interface{}) {
 }
 
 func main() {
+	// Admin subcommands run instead of the server
+	args := parseGlobalFlags(os.Args[1:])
+	if len(args) > 0 && args[0] != "serve" {
+		os.Exit(runCommand(args[0], args[1:]))
+	}
+	// serve also accepts the flags after the command name
+	if len(args) > 0 && len(parseGlobalFlags(args[1:])) > 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+
 	// Initialize the structured logger
 	InitLogger()
 
@@ -52,21 +66,36 @@ func main() {
 	middleware.LogError = LogError
 	middleware.LogDebug = LogDebug
 
-	// Load configuration
-	cfg := config.New()
+	// Load configuration, refusing to start with invalid settings
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		Logger.Fatal().Err(err).Str("configFile", configPath).Msg("Invalid configuration")
+	}
 	Logger.Info().
+		Str("configFile", configPath).
 		Str("port", cfg.Port).
 		Int64("maxUploadSize", cfg.MaxUploadSize).
 		Strs("allowedTypes", cfg.AllowedTypes).
 		Msg("Configuration loaded")
 
+	// Build the expiry policy from the configured options
+	expiryPolicy, err := models.NewExpiryPolicy(cfg.ExpiryOptions, cfg.DefaultExpiry, cfg.MaxRetention)
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("Invalid expiry configuration")
+	}
+
 	// Check dependencies before starting
 	if err := checkDependencies(cfg); err != nil {
 		Logger.Fatal().Err(err).Msg("Failed dependency check")
 	}
 
-	// Initialize storage with logger
-	store, err := storage.New(cfg, &StorageLogger{})
+	// Background routines stop when this is cancelled during shutdown
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Initialize storage with logger. It is closed last, once everything
+	// using it has stopped.
+	store, err := storage.New(background, cfg, &StorageLogger{})
 	if err != nil {
 		Logger.Fatal().Err(err).Msg("Failed to initialize storage")
 	}
@@ -77,13 +106,29 @@ func main() {
 		}
 	}(store)
 
+	// Export traces if enabled; the OTLP exporter reads the OTEL_* variables
+	if cfg.TracingEnabled {
+		shutdownTracing, err := tracing.Setup(context.Background())
+		if err != nil {
+			Logger.Fatal().Err(err).Msg("Failed to initialize tracing")
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				Logger.Error().Err(err).Msg("Failed to flush traces")
+			}
+		}()
+	}
+
 	// Initialize rate limiters with different rates
-	uploadRateLimiter := utils.NewRateLimiter(cfg.RateLimit/10, cfg.RateLimitWindow, cfg.RateLimitCleanup)     // Stricter for uploads
-	chunkUploadRateLimiter := utils.NewRateLimiter(cfg.RateLimit*5, cfg.RateLimitWindow, cfg.RateLimitCleanup) // Much more permissive for chunks
-	apiRateLimiter := utils.NewRateLimiter(cfg.RateLimit, cfg.RateLimitWindow, cfg.RateLimitCleanup)           // Normal for regular requests
+	uploadRateLimiter := utils.NewRateLimiter(background, cfg.RateLimit/10, cfg.RateLimitWindow, cfg.RateLimitCleanup)     // Stricter for uploads
+	chunkUploadRateLimiter := utils.NewRateLimiter(background, cfg.RateLimit*5, cfg.RateLimitWindow, cfg.RateLimitCleanup) // Much more permissive for chunks
+	apiRateLimiter := utils.NewRateLimiter(background, cfg.RateLimit, cfg.RateLimitWindow, cfg.RateLimitCleanup)           // Normal for regular requests
+	apiKeyRateLimiter := utils.NewRateLimiter(background, cfg.APIKeyRateLimit, cfg.RateLimitWindow, cfg.RateLimitCleanup)  // Per key for API clients
 
 	// Initialize CSRF protection with logger
-	csrfProtection := utils.NewCSRFProtection(cfg.CSRFExpiration, &CSRFLogger{})
+	csrfProtection := utils.NewCSRFProtection(background, cfg.CSRFExpiration, &CSRFLogger{})
 
 	// Initialize router with middleware
 	r := chi.NewRouter()
@@ -91,16 +136,18 @@ func main() {
 	// Add standard middlewares
 	r.Use(chi_middleware.RealIP)
 	r.Use(middleware.RequestIDMiddleware)
+	r.Use(middleware.TracingMiddleware)
 	r.Use(middleware.LoggingMiddleware)
 	r.Use(middleware.CustomRecoverer)
-	r.Use(chi_middleware.Compress(5))
+	r.Use(middleware.CompressMiddleware(5))
 	r.Use(chi_middleware.Timeout(30 * time.Minute))
 
 	// Add CORS middleware
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{cfg.BaseURL},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Content-Type", "Range", "X-CSRF-Token", "X-Requested-With", "X-Chunk-Token"},
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Range", "X-CSRF-Token", "X-Requested-With", "X-Chunk-Token", "X-Delete-Token", "X-Resume-Token", "X-Filename", "X-Expiry", "X-Max-Downloads", "X-Encrypted", "X-Encrypted-Sample", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Defer-Length"},
+		ExposedHeaders:   []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Expires", "X-File-URL", "X-Delete-Token", "X-Request-ID", "X-Trace-ID"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -108,31 +155,78 @@ func main() {
 	// Add security headers middleware
 	r.Use(middleware.SecurityHeadersMiddleware)
 
+	// Authenticate API keys before rate limiting, so keys get their own bucket
+	r.Use(middleware.APIKeyMiddleware(func(token string) (*models.APIKey, error) {
+		return store.GetAPIKeyByHash(utils.HashToken(token))
+	}))
+
 	// Add rate limiter middleware
-	r.Use(middleware.RateLimiterMiddleware(uploadRateLimiter, chunkUploadRateLimiter, apiRateLimiter))
+	r.Use(middleware.RateLimiterMiddleware(uploadRateLimiter, chunkUploadRateLimiter, apiRateLimiter, apiKeyRateLimiter))
+
+	// Reject invalid API keys only after the per-IP limit, so guessing keys
+	// is rate limited
+	r.Use(middleware.RejectInvalidAPIKeyMiddleware)
 
 	// Add body size limiting middleware for non-upload endpoints
 	r.Use(middleware.BodyLimiterMiddleware())
 
 	// Create handlers
-	h := handlers.New(cfg, store, csrfProtection)
+	h := handlers.New(background, cfg, store, csrfProtection, expiryPolicy)
 
 	// Register routes
 	r.Get("/", h.Index)
 	r.Post("/upload", h.Upload)
 	r.Post("/upload/chunk", h.ChunkUpload)
 	r.Post("/upload/finalize", h.FinalizeUpload)
+	// tus resumable upload protocol
+	r.Options("/tus", h.TusOptions)
+	r.Options("/tus/", h.TusOptions)
+	r.Post("/tus", h.TusCreate)
+	r.Post("/tus/", h.TusCreate)
+	r.Options("/tus/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.TusOptions)
+	r.Head("/tus/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.TusHead)
+	r.Patch("/tus/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.TusPatch)
+	r.Delete("/tus/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.TusDelete)
+	r.Get("/upload/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}/status", h.UploadStatus)
 	r.Get("/file/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}.sample", h.ServeEncryptedSample)
 	r.Get("/file/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.ServeFileByID)
+	r.Delete("/file/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.DeleteFile)
+	r.Post("/file/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}/delete", h.DeleteFileForm)
+	r.Route("/api/v1", func(r chi.Router) {
+		r.NotFound(h.APINotFound)
+		r.MethodNotAllowed(h.APIMethodNotAllowed)
+		r.Get("/openapi.json", h.APISpec)
+		r.Get("/expiry-options", h.APIExpiryOptions)
+		r.Post("/files", h.APICreateFile)
+		r.Get("/files/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.APIGetFile)
+		r.Delete("/files/{fileID:[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}}", h.APIDeleteFile)
+		r.Get("/admin/files", h.APIAdminListFiles)
+		r.Get("/admin/apikeys", h.APIAdminListAPIKeys)
+		r.Post("/admin/apikeys", h.APIAdminCreateAPIKey)
+		r.Delete("/admin/apikeys/{keyID:[a-f0-9]{16}}", h.APIAdminRevokeAPIKey)
+	})
+	r.Post("/", h.RawUpload)
+	r.Put("/{filename}", h.RawUpload)
 	r.Get("/error", h.ErrorPage)
 	r.Get("/terms", h.Terms)
 	r.Get("/privacy", h.Privacy)
 
-	// Health check endpoint
+	// Health check endpoints; /health is kept for existing monitors
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(`{"status":"ok"}`))
 	})
+	r.Get("/livez", h.Livez)
+	r.Get("/readyz", h.Readyz)
+
+	// Prometheus metrics endpoint
+	if cfg.MetricsEnabled {
+		metrics.RegisterStore(func() (int, int64, error) {
+			stats, err := store.Stats()
+			return stats.Keys, stats.Size, err
+		}, store.CountUploadSessions)
+		r.Get("/metrics", metrics.Handler().ServeHTTP)
+	}
 
 	// Serve static files
 	fileServer := http.FileServer(http.Dir("static"))
@@ -163,21 +257,43 @@ func main() {
 
 	// Wait for interrupt signal
 	<-stop
-	Logger.Info().Msg("Shutting down server...")
+	Logger.Info().Dur("drainTimeout", cfg.DrainTimeout).Msg("Shutting down server...")
 
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Fail readiness checks and refuse new uploads, while uploads in
+	// progress and requests in flight get until the drain timeout to finish
+	h.SetDraining()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
 	defer cancel()
 
-	// First set the server to not accept new connections
+	// A second signal stops waiting for uploads
+	drainCtx, skipDrain := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-stop:
+			Logger.Warn().Msg("Second signal received, not waiting for uploads")
+			skipDrain()
+		case <-drainCtx.Done():
+		}
+	}()
+	if err := h.WaitForUploads(drainCtx); err != nil {
+		Logger.Warn().Err(err).Msg("Stopped waiting for uploads to finish")
+	} else {
+		Logger.Info().Msg("No uploads in progress")
+	}
+	skipDrain()
+
+	// Stop accepting new connections and wait for requests in flight
 	server.SetKeepAlivesEnabled(false)
 	Logger.Info().Msg("Stopped accepting new connections")
-
-	// Shutdown server
 	if err := server.Shutdown(ctx); err != nil {
-		Logger.Fatal().Err(err).Msg("Server forced to shutdown")
+		Logger.Error().Err(err).Msg("Requests still in flight at the drain timeout, closing connections")
+		_ = server.Close()
 	}
 
+	// Stop the background routines before the storage they use is closed
+	stopBackground()
+	h.Wait()
+
 	Logger.Info().Msg("Server gracefully stopped")
 }
 
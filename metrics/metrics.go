@@ -0,0 +1,154 @@
+// Package metrics defines the Prometheus metrics exported on /metrics
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Upload types used as the "type" label
+const (
+	// UploadSingle is a file sent in one request: the upload form, the raw
+	// upload endpoints and the API
+	UploadSingle = "single"
+	// UploadChunked is a file assembled from chunks or tus PATCH requests
+	UploadChunked = "chunked"
+)
+
+// Registry holds every uploadfish metric plus the Go runtime and process
+// collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	// UploadsTotal counts completed uploads by type
+	UploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploadfish_uploads_total",
+		Help: "Completed uploads by type (single or chunked).",
+	}, []string{"type"})
+
+	// UploadSize records the size of completed uploads by type
+	UploadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "uploadfish_upload_size_bytes",
+		Help:    "Size of completed uploads by type (single or chunked).",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 11), // 1KB to 1TB
+	}, []string{"type"})
+
+	// BytesReceived counts file content received, including chunks of
+	// uploads that are never finished
+	BytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploadfish_bytes_received_total",
+		Help: "File content bytes received from uploads.",
+	})
+
+	// BytesSent counts file content sent to downloads
+	BytesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploadfish_bytes_sent_total",
+		Help: "File content bytes sent to downloads.",
+	})
+
+	// DownloadDuration records how long file downloads take to stream
+	DownloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "uploadfish_download_duration_seconds",
+		Help:    "Time taken to stream a file download.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800},
+	})
+
+	// ChunkHashMismatches counts chunks rejected because their hash did not match
+	ChunkHashMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploadfish_chunk_hash_mismatches_total",
+		Help: "Upload chunks rejected because their SHA-256 hash did not match.",
+	})
+
+	// CSRFRejections counts requests rejected for a missing or invalid CSRF token
+	CSRFRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploadfish_csrf_rejections_total",
+		Help: "Requests rejected for a missing or invalid CSRF token.",
+	})
+
+	// RateLimitHits counts requests rejected by a rate limiter
+	RateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "uploadfish_rate_limit_hits_total",
+		Help: "Requests rejected by a rate limiter, by limit type.",
+	}, []string{"limit_type"})
+
+	// ExpiredFilesRemoved counts files deleted by the expiry cleanup
+	ExpiredFilesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploadfish_expired_files_removed_total",
+		Help: "Expired files deleted by the periodic cleanup.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UploadsTotal,
+		UploadSize,
+		BytesReceived,
+		BytesSent,
+		DownloadDuration,
+		ChunkHashMismatches,
+		CSRFRejections,
+		RateLimitHits,
+		ExpiredFilesRemoved,
+	)
+}
+
+// RecordUpload counts a completed upload of the given type and size
+func RecordUpload(uploadType string, size int64) {
+	UploadsTotal.WithLabelValues(uploadType).Inc()
+	UploadSize.WithLabelValues(uploadType).Observe(float64(size))
+}
+
+// storeCollector reads the store gauges when metrics are scraped
+type storeCollector struct {
+	dbStats        func() (keys int, size int64, err error)
+	uploadSessions func() (int, error)
+
+	keys     *prometheus.Desc
+	size     *prometheus.Desc
+	sessions *prometheus.Desc
+}
+
+// RegisterStore exports gauges for the database keys and size and the
+// number of unfinished upload sessions, calling the given functions on each
+// scrape
+func RegisterStore(dbStats func() (keys int, size int64, err error), uploadSessions func() (int, error)) {
+	Registry.MustRegister(&storeCollector{
+		dbStats:        dbStats,
+		uploadSessions: uploadSessions,
+		keys: prometheus.NewDesc("uploadfish_db_keys",
+			"Keys in the BitCask database.", nil, nil),
+		size: prometheus.NewDesc("uploadfish_db_size_bytes",
+			"Size of the BitCask database on disk.", nil, nil),
+		sessions: prometheus.NewDesc("uploadfish_upload_sessions",
+			"Unfinished chunked and tus upload sessions.", nil, nil),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.size
+	ch <- c.sessions
+}
+
+// Collect implements prometheus.Collector. A gauge whose value can't be read
+// is left out of the scrape rather than failing it.
+func (c *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	if keys, size, err := c.dbStats(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(keys))
+		ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size))
+	}
+	if sessions, err := c.uploadSessions(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(sessions))
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
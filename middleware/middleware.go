@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,9 +10,17 @@ import (
 	"strings"
 	"time"
 
+	"uploadfish/metrics"
+	"uploadfish/models"
+	"uploadfish/tracing"
 	"uploadfish/utils"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 // Define custom type for context keys to avoid collisions
@@ -21,6 +30,8 @@ type contextKey string
 const (
 	contextKeyCSPNonce  contextKey = "csp-nonce"
 	contextKeyRequestID contextKey = "request-id"
+	// Set on requests with an unknown API key, rejected after rate limiting
+	contextKeyInvalidAPIKey contextKey = "invalid-api-key"
 )
 
 // Logger functions - these need to be initialized from main package
@@ -54,12 +65,16 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 				"remote_addr": r.RemoteAddr,
 				"user_agent":  r.UserAgent(),
 			}
+			if traceID := tracing.TraceID(r.Context()); traceID != "" {
+				fields["trace_id"] = traceID
+			}
 			// Log based on status code
 			if LogError != nil && ww.Status() >= 500 {
 				LogError(nil, "Server error", fields)
 			} else if LogInfo != nil && ww.Status() >= 400 {
 				LogInfo("Client error", fields)
-			} else if LogInfo != nil {
+			} else if LogInfo != nil && !isProbe(r.URL.Path) {
+				// Successful probes would drown out everything else
 				LogInfo("Request completed", fields)
 			}
 		}()
@@ -134,6 +149,40 @@ func RequestIDMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// TracingMiddleware starts a server span for each request, continuing a trace
+// from a traceparent header. All of the request's spans record the request
+// ID and the ID of the trace is returned in the X-Trace-ID header, so a
+// request's log lines and its trace can be found from either.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		requestID, _ := ctx.Value(contextKeyRequestID).(string)
+		ctx = tracing.WithRequestID(ctx, requestID)
+		ctx, span := tracing.StartServer(ctx, "HTTP "+r.Method,
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		)
+		defer span.End()
+
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			w.Header().Set("X-Trace-ID", traceID)
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		// The route is only known once chi has matched the request
+		if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+			span.SetName("HTTP " + r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(ww.Status()))
+		if ww.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+		}
+	})
+}
+
 // CustomRecoverer is a custom middleware that recovers from panics and logs them
 func CustomRecoverer(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -168,11 +217,13 @@ func CustomRecoverer(next http.Handler) http.Handler {
 }
 
 // RateLimiterMiddleware applies different rate limits based on the request path
-func RateLimiterMiddleware(uploadLimiter, chunkLimiter, apiLimiter *utils.RateLimiter) func(next http.Handler) http.Handler {
+// Requests authenticated with an API key are counted per key in apiKeyLimiter
+func RateLimiterMiddleware(uploadLimiter, chunkLimiter, apiLimiter, apiKeyLimiter *utils.RateLimiter) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Skip rate limiting for static resources and health check
-			if strings.HasPrefix(r.URL.Path, "/static/") || r.URL.Path == "/health" {
+			// Skip rate limiting for static resources, health checks and metrics
+			// scrapes, unless they carry an invalid API key
+			if (strings.HasPrefix(r.URL.Path, "/static/") || isProbe(r.URL.Path)) && !invalidAPIKey(r) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -192,11 +243,25 @@ func RateLimiterMiddleware(uploadLimiter, chunkLimiter, apiLimiter *utils.RateLi
 			var limiter *utils.RateLimiter
 			var limitType string
 
-			// Select the appropriate limiter
-			if r.Method == "POST" && r.URL.Path == "/upload" {
+			// Select the appropriate limiter. Requests with an invalid API key
+			// always count against the client's IP, even on unlimited paths.
+			if invalidAPIKey(r) {
+				limiter = apiLimiter
+				limitType = "api"
+			} else if key := utils.APIKeyFromContext(r.Context()); key != nil {
+				limiter = apiKeyLimiter
+				limitType = "API key"
+				cleanIP = "key:" + key.ID
+			} else if r.Method == "POST" && r.URL.Path == "/upload" {
+				limiter = uploadLimiter
+				limitType = "upload"
+			} else if isRawUpload(r) {
+				limiter = uploadLimiter
+				limitType = "upload"
+			} else if r.Method == "POST" && (r.URL.Path == "/tus" || r.URL.Path == "/tus/") {
 				limiter = uploadLimiter
 				limitType = "upload"
-			} else if r.Method == "POST" && r.URL.Path == "/upload/chunk" {
+			} else if (r.Method == "POST" && r.URL.Path == "/upload/chunk") || strings.HasPrefix(r.URL.Path, "/tus/") {
 				limiter = chunkLimiter
 				limitType = "chunk upload"
 			} else if r.Method == "POST" && r.URL.Path == "/upload/finalize" {
@@ -210,13 +275,14 @@ func RateLimiterMiddleware(uploadLimiter, chunkLimiter, apiLimiter *utils.RateLi
 
 			// Apply the selected rate limit
 			if !limiter.Allow(cleanIP) {
+				metrics.RateLimitHits.WithLabelValues(limitType).Inc()
 				if LogInfo != nil {
 					LogInfo(fmt.Sprintf("Rate limit exceeded for %s", limitType), map[string]interface{}{
 						"ip":   cleanIP,
 						"path": r.URL.Path,
 					})
 				}
-				http.Error(w, fmt.Sprintf("%s rate limit exceeded", strings.Title(limitType)), http.StatusTooManyRequests)
+				writeError(w, r, http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("%s rate limit exceeded", strings.Title(limitType)))
 				return
 			}
 
@@ -225,6 +291,69 @@ func RateLimiterMiddleware(uploadLimiter, chunkLimiter, apiLimiter *utils.RateLi
 	}
 }
 
+// APIKeyMiddleware authenticates requests carrying an "Authorization: Bearer"
+// API key and stores the key in the request context. Requests without one
+// pass through unchanged; an unknown key is marked for
+// RejectInvalidAPIKeyMiddleware to reject once the rate limit has applied.
+func APIKeyMiddleware(lookup func(token string) (*models.APIKey, error)) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := utils.BearerToken(r)
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key, err := lookup(token)
+			if err != nil {
+				if LogInfo != nil {
+					LogInfo("Invalid API key", map[string]interface{}{
+						"remote_addr": r.RemoteAddr,
+						"path":        r.URL.Path,
+					})
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyInvalidAPIKey, true)))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(utils.WithAPIKey(r.Context(), key)))
+		})
+	}
+}
+
+// RejectInvalidAPIKeyMiddleware rejects requests marked by APIKeyMiddleware
+// as carrying an unknown API key
+func RejectInvalidAPIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if invalidAPIKey(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, r, http.StatusUnauthorized, "unauthorized", "Invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// invalidAPIKey reports whether the request carries an unknown API key
+func invalidAPIKey(r *http.Request) bool {
+	invalid, _ := r.Context().Value(contextKeyInvalidAPIKey).(bool)
+	return invalid
+}
+
+// writeError writes an error response, using the JSON API error format for
+// /api/ requests and plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, code string, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]string{"code": code, "message": message},
+		})
+		return
+	}
+	http.Error(w, message, statusCode)
+}
+
 // BodyLimiterMiddleware limits request body size for non-upload endpoints
 func BodyLimiterMiddleware() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -233,7 +362,9 @@ func BodyLimiterMiddleware() func(next http.Handler) http.Handler {
 			if r.URL.Path == "/upload" ||
 				r.URL.Path == "/upload/chunk" ||
 				r.URL.Path == "/upload/finalize" ||
-				strings.HasPrefix(r.URL.Path, "/static/") {
+				strings.HasPrefix(r.URL.Path, "/tus/") ||
+				strings.HasPrefix(r.URL.Path, "/static/") ||
+				isRawUpload(r) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -245,6 +376,50 @@ func BodyLimiterMiddleware() func(next http.Handler) http.Handler {
 	}
 }
 
+// CompressMiddleware compresses pages, scripts, styles and JSON. Downloads of
+// file content are passed through untouched: compressing them would answer
+// range requests with a re-encoded body and drop the Content-Length that
+// clients check when resuming.
+func CompressMiddleware(level int) func(next http.Handler) http.Handler {
+	compress := middleware.Compress(level,
+		"text/html", "text/css", "text/javascript", "application/javascript", "application/json")
+	return func(next http.Handler) http.Handler {
+		compressed := compress(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isFileDownload(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			compressed.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isFileDownload reports whether the request is for a file's content or
+// encrypted sample rather than its preview page
+func isFileDownload(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/file/") {
+		return false
+	}
+	return r.URL.Query().Get("dl") == "true" || strings.HasSuffix(r.URL.Path, ".sample")
+}
+
+// isProbe reports whether the path is polled by monitoring: the health
+// checks and the metrics endpoint
+func isProbe(path string) bool {
+	switch path {
+	case "/health", "/livez", "/readyz", "/metrics":
+		return true
+	}
+	return false
+}
+
+// isRawUpload reports whether the request uploads a file as its raw body,
+// either PUT /{filename}, POST / or POST /api/v1/files
+func isRawUpload(r *http.Request) bool {
+	return r.Method == "PUT" || (r.Method == "POST" && (r.URL.Path == "/" || r.URL.Path == "/api/v1/files"))
+}
+
 // CacheControlMiddleware adds cache headers for static assets
 func CacheControlMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// APIKey is an API key for programmatic clients. Only the hash of the secret
+// key is stored; the key itself is shown once when it is created.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	// Admin keys may also use the /api/v1/admin endpoints
+	Admin bool `json:"admin,omitempty"`
+
+	// Optional per-key limits that replace the server's upload limits
+	MaxUploadSize int64    `json:"max_upload_size,omitempty"` // 0 uses the server's maximum upload size, which it may not exceed
+	ExpiryOptions []string `json:"expiry_options,omitempty"`  // Empty uses the server's expiry options
+	DefaultExpiry string   `json:"default_expiry,omitempty"`
+}
+
+// APIKeyID derives the public ID of an API key from the hash of its secret,
+// so a key can be looked up by ID without storing the hash in the key name
+func APIKeyID(keyHash string) string {
+	if len(keyHash) > 16 {
+		return keyHash[:16]
+	}
+	return keyHash
+}
+
+// ExpiryPolicy builds the expiry policy for uploads made with this key.
+// Returns nil if the key uses the server's expiry options. The server's
+// maximum retention still applies.
+func (k *APIKey) ExpiryPolicy(maxRetention time.Duration) (*ExpiryPolicy, error) {
+	if len(k.ExpiryOptions) == 0 {
+		return nil, nil
+	}
+	defaultValue := k.DefaultExpiry
+	if defaultValue == "" {
+		defaultValue = k.ExpiryOptions[0]
+	}
+	return NewExpiryPolicy(k.ExpiryOptions, defaultValue, maxRetention)
+}
+
+// Validate checks the key's name and limits, including that its upload size
+// and expiry options fit within the server's maximum upload size and retention
+func (k *APIKey) Validate(maxUploadSize int64, maxRetention time.Duration) error {
+	if k.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if k.MaxUploadSize < 0 {
+		return fmt.Errorf("max upload size must not be negative")
+	}
+	if k.MaxUploadSize > maxUploadSize {
+		return fmt.Errorf("max upload size must not exceed the server's maximum of %d bytes", maxUploadSize)
+	}
+	if k.DefaultExpiry != "" && len(k.ExpiryOptions) == 0 {
+		return fmt.Errorf("default expiry requires expiry options")
+	}
+	_, err := k.ExpiryPolicy(maxRetention)
+	return err
+}
+
+// ToJSON converts the API key to JSON
+func (k *APIKey) ToJSON() ([]byte, error) {
+	return json.Marshal(k)
+}
+
+// FromJSON parses JSON data into the API key
+func (k *APIKey) FromJSON(data []byte) error {
+	return json.Unmarshal(data, k)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpiryWhenDownloaded is the expiry value for files deleted after their first download
+const ExpiryWhenDownloaded = "when_downloaded"
+
+// ExpiryOption represents the available expiry time options
+type ExpiryOption struct {
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Value       string `json:"value"`
+}
+
+// ExpiryPolicy is the single source of truth for which expiry values an
+// upload may choose, the default, and the longest time a file may be kept
+type ExpiryPolicy struct {
+	options      []ExpiryOption
+	durations    map[string]time.Duration
+	defaultValue string
+	maxRetention time.Duration
+}
+
+// NewExpiryPolicy builds an expiry policy from configured option values such as
+// "1h", "24h" or "7d". The default must be one of the options. A non-zero
+// maxRetention rejects longer options and also bounds "when_downloaded" files.
+func NewExpiryPolicy(values []string, defaultValue string, maxRetention time.Duration) (*ExpiryPolicy, error) {
+	if maxRetention < 0 {
+		return nil, fmt.Errorf("maximum retention must not be negative")
+	}
+
+	p := &ExpiryPolicy{
+		durations:    make(map[string]time.Duration),
+		defaultValue: defaultValue,
+		maxRetention: maxRetention,
+	}
+
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		duration, err := ParseExpiryDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		if maxRetention > 0 && duration > maxRetention {
+			return nil, fmt.Errorf("expiry option %q is longer than the maximum retention of %s", value, maxRetention)
+		}
+		if _, exists := p.durations[value]; exists {
+			return nil, fmt.Errorf("duplicate expiry option %q", value)
+		}
+
+		p.durations[value] = duration
+		label := formatExpiryLabel(duration)
+		p.options = append(p.options, ExpiryOption{
+			Label:       label,
+			Description: "Delete after " + strings.ToLower(label),
+			Value:       value,
+		})
+	}
+
+	if len(p.options) == 0 {
+		return nil, fmt.Errorf("at least one expiry option is required")
+	}
+	if _, ok := p.durations[defaultValue]; !ok {
+		return nil, fmt.Errorf("default expiry %q is not one of the expiry options", defaultValue)
+	}
+
+	return p, nil
+}
+
+// Options returns the expiry options in their configured order
+func (p *ExpiryPolicy) Options() []ExpiryOption {
+	return p.options
+}
+
+// Default returns the expiry value used when none or an invalid one is given
+func (p *ExpiryPolicy) Default() string {
+	return p.defaultValue
+}
+
+// MaxRetention returns the longest time a file may be kept, or 0 for no limit
+func (p *ExpiryPolicy) MaxRetention() time.Duration {
+	return p.maxRetention
+}
+
+// IsValid reports whether the value is an allowed expiry option or "when_downloaded"
+func (p *ExpiryPolicy) IsValid(value string) bool {
+	if value == ExpiryWhenDownloaded {
+		return true
+	}
+	_, ok := p.durations[value]
+	return ok
+}
+
+// ExpiryTime returns when a file uploaded now with the given valid expiry value
+// expires. "when_downloaded" files only expire by time when a maximum
+// retention is configured; otherwise the zero time is returned.
+func (p *ExpiryPolicy) ExpiryTime(value string, now time.Time) time.Time {
+	if duration, ok := p.durations[value]; ok {
+		return now.Add(duration)
+	}
+	if p.maxRetention > 0 {
+		return now.Add(p.maxRetention)
+	}
+	return time.Time{}
+}
+
+// ParseExpiryDuration parses an expiry option value to its duration.
+// Accepts Go durations ("90m", "6h") and whole days ("7d").
+func ParseExpiryDuration(value string) (time.Duration, error) {
+	var duration time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry option %q", value)
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		duration, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry option %q", value)
+		}
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("expiry option %q must be positive", value)
+	}
+	return duration, nil
+}
+
+// formatExpiryLabel describes a duration for display, e.g. "6 Hours" or "3 Days"
+func formatExpiryLabel(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour && d%(24*time.Hour) == 0:
+		return pluralize(int64(d/(24*time.Hour)), "Day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return pluralize(int64(d/time.Hour), "Hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return pluralize(int64(d/time.Minute), "Minute")
+	default:
+		return d.String()
+	}
+}
+
+// pluralize formats a count with a singular or plural unit
+func pluralize(n int64, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
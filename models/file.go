@@ -5,48 +5,18 @@ import (
 	"time"
 )
 
-// ExpiryOption represents the available expiry time options
-type ExpiryOption struct {
-	Label       string `json:"label"`
-	Description string `json:"description"`
-	Value       string `json:"value"`
-}
-
-// GetExpiryOptions returns the available expiry options
-func GetExpiryOptions() []ExpiryOption {
+// GetDownloadLimitOptions returns the available download limit options
+// A value of "0" means the file can be downloaded any number of times
+func GetDownloadLimitOptions() []ExpiryOption {
 	return []ExpiryOption{
-		{Label: "1 Hour", Description: "Delete after 1 hour", Value: "1h"},
-		{Label: "6 Hours", Description: "Delete after 6 hours", Value: "6h"},
-		{Label: "24 Hours", Description: "Delete after 24 hours", Value: "24h"},
-		{Label: "3 Days", Description: "Delete after 3 days", Value: "72h"},
+		{Label: "No Limit", Description: "Keep until the file expires", Value: "0"},
+		{Label: "1 Download", Description: "Delete after 1 download", Value: "1"},
+		{Label: "5 Downloads", Description: "Delete after 5 downloads", Value: "5"},
+		{Label: "10 Downloads", Description: "Delete after 10 downloads", Value: "10"},
+		{Label: "25 Downloads", Description: "Delete after 25 downloads", Value: "25"},
 	}
 }
 
-// ParseExpiryDuration parses an expiry option value to its duration
-// Only accepts the predefined values: "1h", "6h", "24h", "72h"
-// Any other value will result in the default duration (24 hours)
-func ParseExpiryDuration(value string) time.Duration {
-	// Default: 24 hours
-	duration := 24 * time.Hour
-
-	switch value {
-	case "1h":
-		duration = 1 * time.Hour
-	case "6h":
-		duration = 6 * time.Hour
-	case "24h":
-		duration = 24 * time.Hour
-	case "72h":
-		duration = 72 * time.Hour
-	default:
-		// Log unexpected values for monitoring
-		// This should not happen as values should be validated before calling this function
-		duration = 24 * time.Hour
-	}
-
-	return duration
-}
-
 // File represents the metadata for an uploaded file
 type File struct {
 	ID              string    `json:"id"`
@@ -58,6 +28,22 @@ type File struct {
 	ExpiryValue     string    `json:"expiry_value,omitempty"` // Stores the raw selected value ("1h", "when_downloaded", etc.)
 	IsEncrypted     bool      `json:"is_encrypted"`
 	EncryptedSample []byte    `json:"encrypted_sample,omitempty"`
+	DeleteTokenHash string    `json:"delete_token_hash,omitempty"` // SHA-256 of the owner's delete token
+	// MaxDownloads is the number of downloads allowed before the file expires; 0 means unlimited
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	// DownloadsRemaining counts down from MaxDownloads as downloads are served
+	DownloadsRemaining int `json:"downloads_remaining,omitempty"`
+	// Codec is how the content is stored ("gzip", "zstd" or "none"); empty means gzip
+	Codec string `json:"codec,omitempty"`
+	// ContentFrameSize is the amount of original content in each stored frame
+	ContentFrameSize int64 `json:"content_frame_size,omitempty"`
+	// ContentIndex holds the stored offset at which each frame starts, used to seek
+	ContentIndex []int64 `json:"content_index,omitempty"`
+}
+
+// HasDownloadLimit reports whether the file expires after a number of downloads
+func (f *File) HasDownloadLimit() bool {
+	return f.MaxDownloads > 0 || f.ExpiryValue == ExpiryWhenDownloaded
 }
 
 // ToJSON converts the file metadata to JSON
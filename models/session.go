@@ -0,0 +1,80 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// MaxUploadChunks is the most chunks a chunked upload may be split into. It
+// bounds the size of the upload's session, which records every chunk's hash.
+const MaxUploadChunks = 1 << 16
+
+// UploadSession is the persisted state of a chunked upload, kept until the
+// upload is finalized or goes stale so interrupted uploads survive a restart
+type UploadSession struct {
+	ID           string    `json:"id"`
+	UploadSecret string    `json:"upload_secret"` // Secret key used for HMAC chunk tokens
+	TotalChunks  int       `json:"total_chunks"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUpdated  time.Time `json:"last_updated"` // Used for cleaning up stale sessions
+	// ReceivedChunks maps each stored chunk index to its verified SHA-256 hash
+	ReceivedChunks map[int]string `json:"received_chunks,omitempty"`
+
+	// Upload metadata sent with the first chunk
+	Filename        string `json:"filename,omitempty"`
+	FileSize        int64  `json:"file_size"`
+	ContentType     string `json:"content_type,omitempty"`
+	IsEncrypted     bool   `json:"is_encrypted"`
+	EncryptedSample []byte `json:"encrypted_sample,omitempty"`
+	Expiry          string `json:"expiry,omitempty"`
+	MaxDownloads    string `json:"max_downloads,omitempty"`
+
+	// tus uploads are written to a single file and track their byte offset
+	Protocol     string `json:"protocol,omitempty"` // "tus" for tus uploads, empty for chunked uploads
+	UploadOffset int64  `json:"upload_offset,omitempty"`
+	TusMetadata  string `json:"tus_metadata,omitempty"` // Raw Upload-Metadata header, echoed on HEAD
+
+	// Empty files skip chunk storage and keep their finished metadata here
+	IsEmptyFile  bool  `json:"is_empty_file,omitempty"`
+	FileMetadata *File `json:"file_metadata,omitempty"`
+}
+
+// MarkChunkReceived records a chunk whose hash has been verified
+func (s *UploadSession) MarkChunkReceived(index int, hash string) {
+	if s.ReceivedChunks == nil {
+		s.ReceivedChunks = make(map[int]string)
+	}
+	s.ReceivedChunks[index] = hash
+}
+
+// MissingChunks returns the indices of chunks not yet received, in order
+func (s *UploadSession) MissingChunks() []int {
+	missing := []int{}
+	for i := 0; i < s.TotalChunks; i++ {
+		if _, ok := s.ReceivedChunks[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// ReceivedChunkIndices returns the indices of received chunks, in order
+func (s *UploadSession) ReceivedChunkIndices() []int {
+	indices := make([]int, 0, len(s.ReceivedChunks))
+	for i := range s.ReceivedChunks {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// ToJSON converts the session to JSON
+func (s *UploadSession) ToJSON() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// FromJSON parses JSON data into the session
+func (s *UploadSession) FromJSON(data []byte) error {
+	return json.Unmarshal(data, s)
+}
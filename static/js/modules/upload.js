@@ -137,17 +137,23 @@ function initializeUploader() {
     }
 
     // --- Helper Function to Set Upload Options ---
-    function _setUploadOptions(expiryElementId, encryptionElementId) {
-        const expiryValue = DOM.byId(expiryElementId)?.value;
-        const validExpiryValues = ["1h", "6h", "24h", "72h", "when_downloaded"];
+    function _setUploadOptions(expiryElementId, encryptionElementId, maxDownloadsElementId) {
+        const expirySelect = DOM.byId(expiryElementId);
+        const expiryValue = expirySelect?.value;
+        // The server renders the allowed options, so they are the valid values
+        const validExpiryValues = expirySelect ? Array.from(expirySelect.options).map(option => option.value) : [];
 
         if (validExpiryValues.includes(expiryValue)) {
             elements.formExpiryInput.value = expiryValue;
         } else {
-            // Default to 1 hour if invalid or element not found
-            elements.formExpiryInput.value = "1h";
+            // Leave empty if invalid or element not found so the server default applies
+            elements.formExpiryInput.value = "";
         }
 
+        // Download limit, "0" means no limit (the server validates the value)
+        const maxDownloadsValue = parseInt(DOM.byId(maxDownloadsElementId)?.value, 10);
+        elements.formMaxDownloadsInput.value = maxDownloadsValue > 0 ? String(maxDownloadsValue) : "0";
+
         const encryptionCheckbox = DOM.byId(encryptionElementId);
         const shouldEncrypt = encryptionCheckbox &&
                               encryptionCheckbox.checked &&
@@ -169,7 +175,7 @@ function initializeUploader() {
         elements.progressText.textContent = '0%';
 
         // Set expiry and encryption using helper
-        const shouldEncrypt = _setUploadOptions('jsExpiry', 'encryptionEnabled');
+        const shouldEncrypt = _setUploadOptions('jsExpiry', 'encryptionEnabled', 'jsMaxDownloads');
 
         // No longer need separate logic here, covered by _setUploadOptions
 
@@ -262,7 +268,8 @@ function initializeUploader() {
             this.options = {
                 chunkUrl: '/upload/chunk',
                 finalizeUrl: '/upload/finalize',
-                getExpiry: () => '1h',
+                getExpiry: () => '',
+                getMaxDownloads: () => '0',
                 getIsEncrypted: () => 'false',
                 getSampleBase64: () => null,
                 onProgress: (progress) => console.log('Progress:', progress),
@@ -392,6 +399,7 @@ function initializeUploader() {
             formData.append('file_size', this.fileSize);
             formData.append('filename', this.file.name);
             formData.append('expiry', this.options.getExpiry());
+            formData.append('max_downloads', this.options.getMaxDownloads());
             formData.append('encrypted', this.options.getIsEncrypted());
             formData.append('chunk_hash', chunkHashHex);
             const sampleBase64 = this.options.getSampleBase64();
@@ -522,6 +530,7 @@ function initializeUploader() {
             finalizeData.append('filename', this.file.name);
             finalizeData.append('file_size', this.fileSize);
             finalizeData.append('expiry', this.options.getExpiry());
+            finalizeData.append('max_downloads', this.options.getMaxDownloads());
             finalizeData.append('encrypted', this.options.getIsEncrypted());
 
             // We no longer use ensureCsrfToken here, using the instance state
@@ -760,6 +769,7 @@ function initializeUploader() {
                 // Instantiate and start the uploader
                 uploader = new ChunkedUploader(encryptedFile, {
                     getExpiry: () => elements.formExpiryInput.value,
+                    getMaxDownloads: () => elements.formMaxDownloadsInput.value,
                     getIsEncrypted: () => 'true',
                     getSampleBase64: () => sampleBase64, // Provide the sample
                     onProgress: (progress) => {
@@ -794,7 +804,7 @@ function initializeUploader() {
 
                         setTimeout(() => {
                             // Use result.url as the redirect URL
-                            window.location.href = (result.url || `/file/${result.file_id}`) + '#' + encryptionKey;
+                            window.location.href = (result.redirect_url || result.url || `/file/${result.file_id}`) + '#' + encryptionKey;
                         }, 500);
                          if (sampleInput && sampleInput.parentNode) { // Cleanup sample input on success
                              elements.uploadForm.removeChild(sampleInput);
@@ -843,6 +853,7 @@ function initializeUploader() {
         setTimeout(() => {
             const uploader = new ChunkedUploader(file, {
                 getExpiry: () => elements.formExpiryInput.value,
+                getMaxDownloads: () => elements.formMaxDownloadsInput.value,
                 getIsEncrypted: () => 'false', // Explicitly false
                 onProgress: (progress) => {
                     // Pass the raw progress object to updateProgress
@@ -876,7 +887,7 @@ function initializeUploader() {
 
                     setTimeout(() => {
                         // Use result.url as the redirect URL
-                        window.location.href = result.url || `/file/${result.file_id}`;
+                        window.location.href = result.redirect_url || result.url || `/file/${result.file_id}`;
                     }, 500);
                     // No need to call resetUploadUI on success
                 },
@@ -960,6 +971,7 @@ function initializeUploader() {
         return {
             formFileInput: DOM.byId('formFileInput'),
             formExpiryInput: DOM.byId('formExpiryInput'),
+            formMaxDownloadsInput: DOM.byId('formMaxDownloadsInput'),
             formEncryptedInput: DOM.byId('formEncryptedInput'),
             jsExpiry: DOM.byId('jsExpiry'),
             encryptionEnabled: DOM.byId('encryptionEnabled'),
@@ -1134,7 +1146,7 @@ function initializeUploader() {
         _setupUIForUpload(); // Reuse the same UI setup
 
         // Set expiry and encryption using helper for Text Tab inputs
-        const shouldEncrypt = _setUploadOptions('textExpiry', 'textEncryptionEnabled');
+        const shouldEncrypt = _setUploadOptions('textExpiry', 'textEncryptionEnabled', 'textMaxDownloads');
 
         // No longer need separate logic here
 
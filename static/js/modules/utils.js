@@ -102,7 +102,7 @@ function saveToHistory(item) {
 
 /**
  * Calculates the expiry timestamp based on the expiry value string.
- * @param {string} expiryValue - e.g., "1h", "6h", "24h", "72h", "when_downloaded".
+ * @param {string} expiryValue - e.g., "30m", "6h", "7d", "when_downloaded".
  * @param {number} uploadTimestamp - The timestamp (ms since epoch) when the upload occurred.
  * @returns {number|null} The expiry timestamp (ms since epoch), or null if invalid/never/when_downloaded.
  */
@@ -122,13 +122,15 @@ function parseExpiryValueToTimestamp(expiryValue, uploadTimestamp) {
     }
 
     switch (unit) {
+        case 'm': // minutes
+            durationMs = value * 60 * 1000;
+            break;
         case 'h': // hours
             durationMs = value * 60 * 60 * 1000;
             break;
         case 'd': // days
             durationMs = value * 24 * 60 * 60 * 1000;
             break;
-        // Add 'm' for minutes or 'w' for weeks if needed later
         default:
             console.warn("Invalid unit in expiry string:", expiryValue);
             return null; // Invalid unit
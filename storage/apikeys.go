@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/prologic/bitcask"
+
+	"uploadfish/models"
+)
+
+// Prefix for API key entries in BitCask, keyed by the API key ID
+const apiKeyPrefix = "apikey:"
+
+// SaveAPIKey stores an API key
+func (s *Storage) SaveAPIKey(key *models.APIKey) error {
+	data, err := key.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.db.Put([]byte(apiKeyPrefix+key.ID), data); err != nil {
+		return fmt.Errorf("failed to save API key: %w", err)
+	}
+	return nil
+}
+
+// GetAPIKeyByHash looks up an API key by the hash of its secret key.
+// Returns ErrNotFound if there is no such key.
+func (s *Storage) GetAPIKeyByHash(keyHash string) (*models.APIKey, error) {
+	key, err := s.getAPIKey(models.APIKeyID(keyHash))
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID is only a prefix of the hash, so compare the whole hash
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(keyHash)) != 1 {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
+
+// getAPIKey reads an API key by ID
+func (s *Storage) getAPIKey(id string) (*models.APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, err := s.db.Get([]byte(apiKeyPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	key := &models.APIKey{}
+	if err := key.FromJSON(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal API key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all stored API keys
+func (s *Storage) ListAPIKeys() ([]*models.APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var keys []*models.APIKey
+	err := s.db.Scan([]byte(apiKeyPrefix), func(k []byte) error {
+		data, err := s.db.Get(k)
+		if err != nil {
+			s.logger.Error(err, "Failed to get API key during scan", map[string]interface{}{"key": string(k)})
+			return nil // Continue with next key
+		}
+
+		key := &models.APIKey{}
+		if err := key.FromJSON(data); err != nil {
+			s.logger.Error(err, "Failed to parse API key during scan", map[string]interface{}{"key": string(k)})
+			return nil // Continue with next key
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning API keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey revokes the API key with the given ID.
+// Returns ErrNotFound if there is no such key.
+func (s *Storage) DeleteAPIKey(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.db.Has([]byte(apiKeyPrefix + id)) {
+		return ErrNotFound
+	}
+	if err := s.db.Delete([]byte(apiKeyPrefix + id)); err != nil {
+		return fmt.Errorf("failed to delete API key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/prologic/bitcask"
+)
+
+const (
+	// bitcaskSegmentSize is the maximum size of a single content segment.
+	// Content is written and read one segment at a time, so memory use per
+	// upload or download is bounded by this value rather than the file size.
+	bitcaskSegmentSize = 4 * 1024 * 1024 // 4MB
+	// Prefix for segment manifests, written once all segments are stored
+	segmentManifestPrefix = "segments:"
+	// Prefix for segment values, followed by "<id>:<index>"
+	segmentPrefix = "segment:"
+)
+
+// segmentManifest records how a file's content was split into segments
+type segmentManifest struct {
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+}
+
+// bitcaskBlobStore keeps content in the same Bitcask database as the metadata.
+// New content is split into fixed-size segments; content written as a single
+// value under contentPrefix by older versions is still readable.
+type bitcaskBlobStore struct {
+	db *bitcask.Bitcask
+}
+
+// newBitcaskBlobStore creates a BlobStore backed by the given database
+func newBitcaskBlobStore(db *bitcask.Bitcask) *bitcaskBlobStore {
+	return &bitcaskBlobStore{db: db}
+}
+
+// segmentKey returns the key of a content segment
+func segmentKey(id string, index int) []byte {
+	return []byte(fmt.Sprintf("%s%s:%06d", segmentPrefix, id, index))
+}
+
+// Put stores the content as a series of segments followed by the manifest
+func (b *bitcaskBlobStore) Put(id string, r io.Reader) (int64, error) {
+	buf := make([]byte, bitcaskSegmentSize)
+	var size int64
+	segments := 0
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if putErr := b.db.Put(segmentKey(id, segments), buf[:n]); putErr != nil {
+				b.deleteSegments(id, segments+1)
+				return size, fmt.Errorf("failed to save content segment %d: %w", segments, putErr)
+			}
+			segments++
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			b.deleteSegments(id, segments)
+			return size, fmt.Errorf("failed to read content: %w", err)
+		}
+	}
+
+	// Write the manifest last so partially stored content is never visible
+	manifest, err := json.Marshal(segmentManifest{Segments: segments, Size: size})
+	if err != nil {
+		b.deleteSegments(id, segments)
+		return size, fmt.Errorf("failed to marshal segment manifest: %w", err)
+	}
+	if err := b.db.Put([]byte(segmentManifestPrefix+id), manifest); err != nil {
+		b.deleteSegments(id, segments)
+		return size, fmt.Errorf("failed to save segment manifest: %w", err)
+	}
+
+	return size, nil
+}
+
+// Get returns a reader that loads one segment at a time
+func (b *bitcaskBlobStore) Get(id string) (io.ReadCloser, error) {
+	manifest, err := b.manifest(id)
+	if err == ErrNotFound {
+		return b.getLegacy(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{db: b.db, id: id, segments: manifest.Segments}, nil
+}
+
+// GetAt returns a reader that starts in the segment containing offset
+func (b *bitcaskBlobStore) GetAt(id string, offset int64) (io.ReadCloser, error) {
+	manifest, err := b.manifest(id)
+	if err == ErrNotFound {
+		reader, err := b.getLegacy(id)
+		if err != nil {
+			return nil, err
+		}
+		legacy := reader.(*segmentReader)
+		legacy.current = legacy.current[min(offset, int64(len(legacy.current))):]
+		return legacy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset > manifest.Size {
+		offset = manifest.Size
+	}
+
+	reader := &segmentReader{db: b.db, id: id, segments: manifest.Segments, next: int(offset / bitcaskSegmentSize)}
+	// Load the first segment and skip to the offset within it
+	if skip := offset % bitcaskSegmentSize; skip > 0 {
+		if _, err := reader.Read(nil); err != nil && err != io.EOF {
+			return nil, err
+		}
+		reader.current = reader.current[skip:]
+	}
+	return reader, nil
+}
+
+// getLegacy reads content stored as a single value by older versions
+func (b *bitcaskBlobStore) getLegacy(id string) (io.ReadCloser, error) {
+	data, err := b.db.Get([]byte(contentPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get content: %w", err)
+	}
+	return &segmentReader{current: data}, nil
+}
+
+// Delete removes the manifest, all segments and any legacy value
+func (b *bitcaskBlobStore) Delete(id string) error {
+	manifest, err := b.manifest(id)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == nil {
+		// Remove the manifest first so readers stop seeing the content
+		if err := b.db.Delete([]byte(segmentManifestPrefix + id)); err != nil && err != bitcask.ErrKeyNotFound {
+			return fmt.Errorf("failed to delete segment manifest: %w", err)
+		}
+		b.deleteSegments(id, manifest.Segments)
+	}
+
+	if err := b.db.Delete([]byte(contentPrefix + id)); err != nil && err != bitcask.ErrKeyNotFound {
+		return fmt.Errorf("failed to delete content: %w", err)
+	}
+	return nil
+}
+
+// Stat returns the stored content size
+func (b *bitcaskBlobStore) Stat(id string) (BlobInfo, error) {
+	manifest, err := b.manifest(id)
+	if err == nil {
+		return BlobInfo{ID: id, Size: manifest.Size}, nil
+	}
+	if err != ErrNotFound {
+		return BlobInfo{}, err
+	}
+
+	data, err := b.db.Get([]byte(contentPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return BlobInfo{}, ErrNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("failed to stat content: %w", err)
+	}
+	return BlobInfo{ID: id, Size: int64(len(data))}, nil
+}
+
+// List calls fn for every segmented and legacy content entry
+func (b *bitcaskBlobStore) List(fn func(id string) error) error {
+	if err := b.db.Scan([]byte(segmentManifestPrefix), func(key []byte) error {
+		return fn(string(key)[len(segmentManifestPrefix):])
+	}); err != nil {
+		return err
+	}
+	return b.db.Scan([]byte(contentPrefix), func(key []byte) error {
+		return fn(string(key)[len(contentPrefix):])
+	})
+}
+
+// manifest loads the segment manifest for an ID
+func (b *bitcaskBlobStore) manifest(id string) (*segmentManifest, error) {
+	data, err := b.db.Get([]byte(segmentManifestPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get segment manifest: %w", err)
+	}
+	manifest := &segmentManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse segment manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// deleteSegments removes the first count segments of an ID, ignoring errors
+func (b *bitcaskBlobStore) deleteSegments(id string, count int) {
+	for i := 0; i < count; i++ {
+		_ = b.db.Delete(segmentKey(id, i))
+	}
+}
+
+// segmentReader streams content one segment at a time
+type segmentReader struct {
+	db       *bitcask.Bitcask
+	id       string
+	segments int    // Total number of segments
+	next     int    // Index of the next segment to load
+	current  []byte // Unread part of the current segment
+}
+
+// Read returns data from the current segment, loading the next one when it runs out
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for len(s.current) == 0 {
+		if s.next >= s.segments {
+			return 0, io.EOF
+		}
+		data, err := s.db.Get(segmentKey(s.id, s.next))
+		if err != nil {
+			return 0, fmt.Errorf("failed to get content segment %d: %w", s.next, err)
+		}
+		s.current = data
+		s.next++
+	}
+
+	n := copy(p, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+// Close releases the current segment
+func (s *segmentReader) Close() error {
+	s.current = nil
+	s.next = s.segments
+	return nil
+}
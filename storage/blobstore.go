@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prologic/bitcask"
+
+	"uploadfish/config"
+)
+
+// ErrNotFound is returned by a BlobStore when no content exists for an ID
+var ErrNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored content blob
+type BlobInfo struct {
+	ID   string
+	Size int64 // Size of the stored (encoded) content in bytes
+}
+
+// BlobStore persists the encoded content of files, keyed by file ID.
+// Metadata always stays in Bitcask; only the content goes through a BlobStore.
+type BlobStore interface {
+	// Put stores the content read from r and returns the number of bytes written
+	Put(id string, r io.Reader) (int64, error)
+	// Get returns a reader for the stored content. The caller must close it.
+	Get(id string) (io.ReadCloser, error)
+	// GetAt returns a reader for the stored content starting at offset
+	GetAt(id string, offset int64) (io.ReadCloser, error)
+	// Delete removes the stored content. Deleting a missing blob is not an error.
+	Delete(id string) error
+	// Stat returns information about the stored content
+	Stat(id string) (BlobInfo, error)
+	// List calls fn for the ID of every stored blob
+	List(fn func(id string) error) error
+}
+
+// Storage backend names accepted in config.Config.StorageBackend
+const (
+	BackendBitcask    = "bitcask"
+	BackendFilesystem = "filesystem"
+	BackendS3         = "s3"
+)
+
+// newBlobStore creates the content backend selected in the configuration
+func newBlobStore(cfg *config.Config, db *bitcask.Bitcask) (BlobStore, error) {
+	switch cfg.StorageBackend {
+	case "", BackendBitcask:
+		return newBitcaskBlobStore(db), nil
+	case BackendFilesystem:
+		return newFilesystemBlobStore(cfg.ContentPath)
+	case BackendS3:
+		return newS3BlobStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names recorded in models.File.Codec. An empty value means gzip, which
+// is how all content was stored before the codec was recorded.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// frameEncoder encodes a single frame and can be reset to start the next one
+type frameEncoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// codec creates encoders and decoders for one storage format
+type codec interface {
+	newEncoder(w io.Writer) (frameEncoder, error)
+	newDecoder(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecFor returns the codec with the given name, configured for this storage
+func (s *Storage) codecFor(name string) (codec, error) {
+	switch name {
+	case "", CodecGzip:
+		return gzipCodec{}, nil
+	case CodecZstd:
+		return zstdCodec{level: zstd.EncoderLevelFromZstd(s.config.ZstdLevel)}, nil
+	case CodecNone:
+		return noneCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// gzipCodec stores content as gzip members
+type gzipCodec struct{}
+
+func (gzipCodec) newEncoder(w io.Writer) (frameEncoder, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) newDecoder(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCodec stores content as Zstandard frames
+type zstdCodec struct {
+	level zstd.EncoderLevel
+}
+
+func (c zstdCodec) newEncoder(w io.Writer) (frameEncoder, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) newDecoder(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// noneCodec stores content as-is
+type noneCodec struct{}
+
+func (noneCodec) newEncoder(w io.Writer) (frameEncoder, error) {
+	return &rawEncoder{w: w}, nil
+}
+
+func (noneCodec) newDecoder(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// rawEncoder passes content through unchanged
+type rawEncoder struct {
+	w io.Writer
+}
+
+func (e *rawEncoder) Write(p []byte) (int, error) { return e.w.Write(p) }
+func (e *rawEncoder) Close() error                { return nil }
+func (e *rawEncoder) Reset(w io.Writer)           { e.w = w }
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+
+	"uploadfish/models"
+)
+
+// Compression policies accepted in config.Config.Compression
+const (
+	CompressionAuto   = "auto"   // Skip compression for content that will not shrink
+	CompressionAlways = "always" // Compress everything
+	CompressionNever  = "never"  // Store everything raw
+)
+
+// compressionTrialSize is how much of the content is test-compressed to decide
+// whether compressing the rest is worthwhile
+const compressionTrialSize = 256 * 1024 // 256KB
+
+// incompressibleTypes lists MIME type prefixes of content that is already
+// compressed, where another compression pass only burns CPU
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"image/heic",
+	"video/",
+	"audio/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/zstd",
+	"application/pdf",
+}
+
+// chooseCodec decides how the content of a file should be stored based on the
+// configured policy. Client-side encrypted files and already-compressed types
+// are stored raw; other content is stored raw if a trial compression of its
+// first bytes does not save enough, and with the configured codec otherwise.
+// It returns the codec name and a reader that still yields the complete content.
+func (s *Storage) chooseCodec(fileMetadata *models.File, contentReader io.Reader) (string, io.Reader, error) {
+	switch s.config.Compression {
+	case CompressionNever:
+		return CodecNone, contentReader, nil
+	case CompressionAlways:
+		return s.compressionCodec(), contentReader, nil
+	}
+
+	// AES-GCM ciphertext is indistinguishable from random data
+	if fileMetadata.IsEncrypted {
+		return CodecNone, contentReader, nil
+	}
+
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(fileMetadata.MimeType, prefix) {
+			return CodecNone, contentReader, nil
+		}
+	}
+
+	// Trial-compress the first part of the content
+	head := make([]byte, compressionTrialSize)
+	n, err := io.ReadFull(contentReader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, fmt.Errorf("failed to read content for compression trial: %w", err)
+	}
+	head = head[:n]
+	contentReader = io.MultiReader(bytes.NewReader(head), contentReader)
+
+	if n == 0 {
+		return s.compressionCodec(), contentReader, nil
+	}
+
+	out := &countingWriter{w: io.Discard}
+	gz, _ := gzip.NewWriterLevel(out, gzip.BestSpeed)
+	if _, err := gz.Write(head); err != nil {
+		return "", nil, fmt.Errorf("failed during compression trial: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return "", nil, fmt.Errorf("failed during compression trial: %w", err)
+	}
+
+	if float64(out.n)/float64(n) > s.config.CompressionMaxRatio {
+		return CodecNone, contentReader, nil
+	}
+	return s.compressionCodec(), contentReader, nil
+}
+
+// compressionCodec returns the configured codec for compressible content
+func (s *Storage) compressionCodec() string {
+	if s.config.CompressionCodec == "" {
+		return CodecGzip
+	}
+	return s.config.CompressionCodec
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prologic/bitcask"
+
+	"uploadfish/models"
+)
+
+// ErrDownloadLimitReached is returned when a file has no downloads remaining
+var ErrDownloadLimitReached = errors.New("download limit reached")
+
+// ClaimDownload takes one download from a file with a download limit.
+// The counter is read and written under the storage lock, so concurrent
+// downloads can never claim more than MaxDownloads between them.
+// Returns the updated metadata, or ErrDownloadLimitReached if none remain.
+func (s *Storage) ClaimDownload(id string) (*models.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := s.getFileLocked(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files uploaded with "when_downloaded" before download counters existed
+	if file.MaxDownloads == 0 && file.ExpiryValue == models.ExpiryWhenDownloaded {
+		file.MaxDownloads = 1
+		file.DownloadsRemaining = 1
+	}
+
+	if file.MaxDownloads == 0 {
+		return file, nil
+	}
+	if file.DownloadsRemaining <= 0 {
+		return nil, ErrDownloadLimitReached
+	}
+
+	file.DownloadsRemaining--
+	if err := s.putFileLocked(file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// ReleaseDownload returns a download claimed by ClaimDownload that was not
+// completed, so an interrupted transfer does not use up the limit
+func (s *Storage) ReleaseDownload(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := s.getFileLocked(id)
+	if err != nil {
+		return err
+	}
+	if file.MaxDownloads == 0 || file.DownloadsRemaining >= file.MaxDownloads {
+		return nil
+	}
+
+	file.DownloadsRemaining++
+	return s.putFileLocked(file)
+}
+
+// getFileLocked reads file metadata; the caller must hold the storage lock
+func (s *Storage) getFileLocked(id string) (*models.File, error) {
+	data, err := s.db.Get([]byte(metadataPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+	}
+
+	file := &models.File{}
+	if err := file.FromJSON(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file metadata: %w", err)
+	}
+	return file, nil
+}
+
+// putFileLocked writes file metadata; the caller must hold the storage lock
+func (s *Storage) putFileLocked(file *models.File) error {
+	data, err := file.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal file metadata: %w", err)
+	}
+	if err := s.db.Put([]byte(metadataPrefix+file.ID), data); err != nil {
+		return fmt.Errorf("failed to save file metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempFilePrefix marks partially written content files
+const tempFilePrefix = ".tmp-"
+
+// filesystemBlobStore keeps each file's content as a plain file in a sharded
+// directory tree, e.g. <root>/ab/cd/abcd1234-.... Deleting a file removes it
+// from disk immediately, so Bitcask merges only have to rewrite metadata.
+type filesystemBlobStore struct {
+	root string
+}
+
+// newFilesystemBlobStore creates a BlobStore rooted at the given directory
+func newFilesystemBlobStore(root string) (*filesystemBlobStore, error) {
+	if root == "" {
+		return nil, fmt.Errorf("content path must be set for the filesystem backend")
+	}
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create content directory: %w", err)
+	}
+	return &filesystemBlobStore{root: root}, nil
+}
+
+// path returns the sharded location of the content for an ID
+func (f *filesystemBlobStore) path(id string) (string, error) {
+	// IDs are UUIDs; reject anything that could escape the content directory
+	if len(id) < 4 || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return "", fmt.Errorf("invalid content ID %q", id)
+	}
+	return filepath.Join(f.root, id[0:2], id[2:4], id), nil
+}
+
+// Put streams the content into a temporary file and renames it into place
+func (f *filesystemBlobStore) Put(id string, r io.Reader) (int64, error) {
+	target, err := f.path(id)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return 0, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+id+"-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create content file: %w", err)
+	}
+	tmpPath := tmp.Name()
+
+	written, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return written, fmt.Errorf("failed to write content file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, target); err != nil {
+		_ = os.Remove(tmpPath)
+		return written, fmt.Errorf("failed to move content file into place: %w", err)
+	}
+
+	return written, nil
+}
+
+// Get opens the content file for reading
+func (f *filesystemBlobStore) Get(id string) (io.ReadCloser, error) {
+	target, err := f.path(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open content file: %w", err)
+	}
+	return file, nil
+}
+
+// GetAt opens the content file and seeks to offset
+func (f *filesystemBlobStore) GetAt(id string, offset int64) (io.ReadCloser, error) {
+	reader, err := f.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	file := reader.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to seek content file: %w", err)
+	}
+	return file, nil
+}
+
+// Delete removes the content file
+func (f *filesystemBlobStore) Delete(id string) error {
+	target, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove content file: %w", err)
+	}
+	return nil
+}
+
+// Stat returns the size of the content file
+func (f *filesystemBlobStore) Stat(id string) (BlobInfo, error) {
+	target, err := f.path(id)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return BlobInfo{}, ErrNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("failed to stat content file: %w", err)
+	}
+	return BlobInfo{ID: id, Size: info.Size()}, nil
+}
+
+// List walks the shard directories and calls fn for every content file
+func (f *filesystemBlobStore) List(fn func(id string) error) error {
+	return filepath.WalkDir(f.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempFilePrefix) {
+			return nil
+		}
+		return fn(d.Name())
+	})
+}
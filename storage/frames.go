@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// contentFrameSize is the amount of original content encoded into each
+// independent frame (a gzip member, for gzip). Recording where every frame
+// starts lets reads seek to a frame instead of decoding the whole file. The
+// concatenated frames are still a single valid stream for the codec.
+const contentFrameSize = 4 * 1024 * 1024 // 4MB
+
+// countingWriter tracks how many bytes have been written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes to the underlying writer and counts the bytes written
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeFrames encodes src into w as a series of frames of at most
+// contentFrameSize original bytes each. It returns the number of original
+// bytes read and the encoded offset at which each frame starts.
+func writeFrames(w io.Writer, src io.Reader, c codec) (int64, []int64, error) {
+	out := &countingWriter{w: w}
+	enc, err := c.newEncoder(out)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create encoder: %w", err)
+	}
+	var written int64
+	var index []int64
+
+	for {
+		frameStart := out.n
+		enc.Reset(out)
+
+		n, err := io.CopyN(enc, src, contentFrameSize)
+		written += n
+		if err != nil && err != io.EOF {
+			return written, index, fmt.Errorf("failed during file content compression: %w", err)
+		}
+
+		// Always emit at least one frame so empty content is still a valid stream
+		if n > 0 || len(index) == 0 {
+			if closeErr := enc.Close(); closeErr != nil { // Important: Close the encoder
+				return written, index, fmt.Errorf("failed to compress file content: %w", closeErr)
+			}
+			index = append(index, frameStart)
+		}
+
+		if err == io.EOF {
+			return written, index, nil
+		}
+	}
+}
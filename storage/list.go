@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"uploadfish/models"
+)
+
+// Expiry modes accepted in FileFilter.ExpiryMode
+const (
+	// ExpiryModeTime matches files that only expire at their expiry time
+	ExpiryModeTime = "time"
+	// ExpiryModeDownloads matches files that also expire after a number of downloads
+	ExpiryModeDownloads = "downloads"
+)
+
+// ErrInvalidCursor is returned by ListFiles for a cursor it did not issue
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FileFilter selects the files returned by ListFiles. Zero values match
+// every file.
+type FileFilter struct {
+	MimePrefix     string    // MIME type prefix, e.g. "image/"
+	MinSize        int64     // Smallest size in bytes
+	MaxSize        int64     // Largest size in bytes; 0 for no limit
+	UploadedAfter  time.Time // Uploaded at or after this time
+	UploadedBefore time.Time // Uploaded before this time
+	Encrypted      *bool     // Only encrypted or only unencrypted files
+	ExpiryMode     string    // ExpiryModeTime or ExpiryModeDownloads
+
+	// Cursor continues a listing from the NextCursor of a previous page
+	Cursor string
+	// Limit is the largest number of files to return; 0 for no limit
+	Limit int
+}
+
+// FileList is a page of files returned by ListFiles
+type FileList struct {
+	Files []*models.File
+	// NextCursor fetches the next page, empty on the last page
+	NextCursor string
+}
+
+// Validate checks the filter for impossible or unknown values
+func (f *FileFilter) Validate() error {
+	switch {
+	case f.MinSize < 0 || f.MaxSize < 0:
+		return fmt.Errorf("sizes must not be negative")
+	case f.MaxSize > 0 && f.MinSize > f.MaxSize:
+		return fmt.Errorf("minimum size is larger than the maximum size")
+	case !f.UploadedAfter.IsZero() && !f.UploadedBefore.IsZero() && !f.UploadedAfter.Before(f.UploadedBefore):
+		return fmt.Errorf("upload time range is empty")
+	case f.ExpiryMode != "" && f.ExpiryMode != ExpiryModeTime && f.ExpiryMode != ExpiryModeDownloads:
+		return fmt.Errorf("unknown expiry mode %q, expected %q or %q", f.ExpiryMode, ExpiryModeTime, ExpiryModeDownloads)
+	case f.Limit < 0:
+		return fmt.Errorf("limit must not be negative")
+	}
+	return nil
+}
+
+// Matches reports whether a file passes the filter, ignoring pagination
+func (f *FileFilter) Matches(file *models.File) bool {
+	switch {
+	case f.MimePrefix != "" && !strings.HasPrefix(file.MimeType, f.MimePrefix):
+		return false
+	case file.Size < f.MinSize:
+		return false
+	case f.MaxSize > 0 && file.Size > f.MaxSize:
+		return false
+	case !f.UploadedAfter.IsZero() && file.UploadTime.Before(f.UploadedAfter):
+		return false
+	case !f.UploadedBefore.IsZero() && !file.UploadTime.Before(f.UploadedBefore):
+		return false
+	case f.Encrypted != nil && file.IsEncrypted != *f.Encrypted:
+		return false
+	case f.ExpiryMode == ExpiryModeTime && file.HasDownloadLimit():
+		return false
+	case f.ExpiryMode == ExpiryModeDownloads && !file.HasDownloadLimit():
+		return false
+	}
+	return true
+}
+
+// after decodes the cursor into the position the page starts after
+func (f *FileFilter) after() (time.Time, string, error) {
+	if f.Cursor == "" {
+		return time.Time{}, "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return time.Unix(0, n), id, nil
+}
+
+// fileCursor encodes the position after a file in the listing order
+func fileCursor(file *models.File) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", file.UploadTime.UnixNano(), file.ID)))
+}
+
+// fileBefore orders files by upload time, then ID
+func fileBefore(aTime time.Time, aID string, bTime time.Time, bID string) bool {
+	if !aTime.Equal(bTime) {
+		return aTime.Before(bTime)
+	}
+	return aID < bID
+}
+
+// fileHeap is a max-heap of files in listing order, used to keep only the
+// first files of a page while scanning
+type fileHeap []*models.File
+
+func (h fileHeap) Len() int { return len(h) }
+func (h fileHeap) Less(i, j int) bool {
+	return fileBefore(h[j].UploadTime, h[j].ID, h[i].UploadTime, h[i].ID)
+}
+func (h fileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x interface{}) { *h = append(*h, x.(*models.File)) }
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// ListFiles returns the stored files that match a filter, oldest first, a
+// page at a time. Every metadata entry is scanned, but with a limit only the
+// first limit+1 matching files after the cursor are kept in memory, so the
+// cost of a page doesn't grow with how many files match.
+func (s *Storage) ListFiles(filter FileFilter) (*FileList, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	afterTime, afterID, err := filter.after()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// One file past the limit shows whether there is another page
+	keep := filter.Limit + 1
+	files := &fileHeap{}
+	err = s.db.Scan([]byte(metadataPrefix), func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			s.logger.Error(err, "Failed to get metadata during file scan", map[string]interface{}{"key": string(key)})
+			return nil // Continue with next key
+		}
+
+		file := &models.File{}
+		if err := file.FromJSON(data); err != nil {
+			s.logger.Error(err, "Failed to parse metadata during file scan", map[string]interface{}{"key": string(key)})
+			return nil // Continue with next key
+		}
+
+		if filter.Cursor != "" && !fileBefore(afterTime, afterID, file.UploadTime, file.ID) {
+			return nil // On an earlier page
+		}
+		if !filter.Matches(file) {
+			return nil
+		}
+		heap.Push(files, file)
+		if filter.Limit > 0 && files.Len() > keep {
+			heap.Pop(files) // Drop the latest, it belongs to a later page
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning files: %w", err)
+	}
+
+	sorted := []*models.File(*files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return fileBefore(sorted[i].UploadTime, sorted[i].ID, sorted[j].UploadTime, sorted[j].ID)
+	})
+
+	list := &FileList{Files: sorted}
+	if filter.Limit > 0 && len(sorted) > filter.Limit {
+		list.Files = sorted[:filter.Limit]
+		list.NextCursor = fileCursor(list.Files[filter.Limit-1])
+	}
+	return list, nil
+}
+
+// StoredSize returns the size of a file's content as stored, after
+// compression. Returns ErrNotFound if no content is stored for the ID.
+func (s *Storage) StoredSize(id string) (int64, error) {
+	info, err := s.blobs.Stat(id)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
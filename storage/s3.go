@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"uploadfish/config"
+)
+
+// s3PartSize is the size of each part in a streaming multipart upload. Memory
+// use per upload is bounded by this value because the total size is unknown.
+const s3PartSize = 16 * 1024 * 1024 // 16MB
+
+// s3BlobStore keeps content as objects in an S3-compatible bucket, so that
+// several instances can share the same content while metadata stays local.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// newS3BlobStore connects to the configured endpoint and ensures the bucket exists
+func newS3BlobStore(cfg *config.Config) (*s3BlobStore, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket must be set for the s3 backend")
+	}
+
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.S3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check S3 bucket: %w", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.S3Bucket, minio.MakeBucketOptions{Region: cfg.S3Region}); err != nil {
+			return nil, fmt.Errorf("failed to create S3 bucket: %w", err)
+		}
+	}
+
+	return &s3BlobStore{
+		client: client,
+		bucket: cfg.S3Bucket,
+		prefix: strings.Trim(cfg.S3Prefix, "/"),
+	}, nil
+}
+
+// key returns the object key for an ID
+func (b *s3BlobStore) key(id string) string {
+	if b.prefix == "" {
+		return id
+	}
+	return b.prefix + "/" + id
+}
+
+// Put streams the content as a multipart upload of unknown length
+func (b *s3BlobStore) Put(id string, r io.Reader) (int64, error) {
+	info, err := b.client.PutObject(context.Background(), b.bucket, b.key(id), r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+		// Skip per-chunk payload signing; not every S3-compatible service
+		// understands the streaming signature format used over plain HTTP
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload object: %w", err)
+	}
+	return info.Size, nil
+}
+
+// Get returns a streaming reader for the object
+func (b *s3BlobStore) Get(id string) (io.ReadCloser, error) {
+	return b.GetAt(id, 0)
+}
+
+// GetAt returns a streaming reader for the object from offset to the end
+func (b *s3BlobStore) GetAt(id string, offset int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, fmt.Errorf("failed to set object range: %w", err)
+		}
+	}
+	// GetObject is lazy; check the object exists before streaming starts
+	if _, err := b.Stat(id); err != nil {
+		return nil, err
+	}
+	obj, err := b.client.GetObject(context.Background(), b.bucket, b.key(id), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	return obj, nil
+}
+
+// Delete removes the object
+func (b *s3BlobStore) Delete(id string) error {
+	if err := b.client.RemoveObject(context.Background(), b.bucket, b.key(id), minio.RemoveObjectOptions{}); err != nil && !isS3NotFound(err) {
+		return fmt.Errorf("failed to remove object: %w", err)
+	}
+	return nil
+}
+
+// Stat returns the size of the object
+func (b *s3BlobStore) Stat(id string) (BlobInfo, error) {
+	info, err := b.client.StatObject(context.Background(), b.bucket, b.key(id), minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return BlobInfo{}, ErrNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("failed to stat object: %w", err)
+	}
+	return BlobInfo{ID: id, Size: info.Size}, nil
+}
+
+// List calls fn for every object under the configured prefix
+func (b *s3BlobStore) List(fn func(id string) error) error {
+	prefix := ""
+	if b.prefix != "" {
+		prefix = b.prefix + "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // Stops the listing goroutine if fn returns early
+
+	for obj := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return fmt.Errorf("failed to list objects: %w", obj.Err)
+		}
+		if err := fn(strings.TrimPrefix(obj.Key, prefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isS3NotFound reports whether err means the object does not exist
+func isS3NotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"uploadfish/config"
+)
+
+// fakeS3 is an in-memory stand-in for an S3-compatible service. It handles
+// just the path-style requests the s3 backend makes: bucket checks, single and
+// multipart uploads, ranged reads, deletes and V2 listings.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]map[int][]byte // Parts of unfinished multipart uploads by upload ID
+	nextID  int
+
+	multipartUploads int // Completed multipart uploads
+	partsUploaded    int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets: make(map[string]map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	if key == "" {
+		f.serveBucket(w, r, bucket, query)
+		return
+	}
+
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = make(map[int][]byte)
+		writeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		parts[number] = data
+		f.partsUploaded++
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, number))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, number := range numbers {
+			object = append(object, parts[number]...)
+		}
+		objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		f.multipartUploads++
+		writeS3XML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"multipart"`})
+
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		objects[key] = data
+		w.Header().Set("ETag", `"object"`)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(object))
+
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// serveBucket handles requests for a bucket rather than an object
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	objects, ok := f.buckets[bucket]
+	switch r.Method {
+	case http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodPut:
+		if !ok {
+			f.buckets[bucket] = make(map[string][]byte)
+		}
+	case http.MethodGet:
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+			return
+		}
+		type object struct {
+			Key  string
+			Size int64
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []object
+		}{Name: bucket, Prefix: query.Get("prefix")}
+		for key, data := range objects {
+			if strings.HasPrefix(key, result.Prefix) {
+				result.Contents = append(result.Contents, object{Key: key, Size: int64(len(data))})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		result.KeyCount = len(result.Contents)
+		writeS3XML(w, result)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func writeS3XML(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(body)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// newTestS3BlobStore starts a fake S3 service and connects a blob store to it
+func newTestS3BlobStore(t *testing.T) (*s3BlobStore, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := newS3BlobStore(&config.Config{
+		S3Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		S3Bucket:   "uploadfish",
+		S3Region:   "us-east-1",
+		S3Prefix:   "content/",
+	})
+	if err != nil {
+		t.Fatalf("newS3BlobStore: %v", err)
+	}
+	if _, ok := fake.buckets["uploadfish"]; !ok {
+		t.Fatal("bucket was not created")
+	}
+	return store, fake
+}
+
+// readBlob reads a blob from offset to the end
+func readBlob(t *testing.T, store BlobStore, id string, offset int64) []byte {
+	t.Helper()
+	reader, err := store.GetAt(id, offset)
+	if err != nil {
+		t.Fatalf("GetAt(%q, %d): %v", id, offset, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading %q: %v", id, err)
+	}
+	return data
+}
+
+func TestS3BlobStorePutGetDelete(t *testing.T) {
+	store, fake := newTestS3BlobStore(t)
+	content := []byte("hello from uploadfish")
+
+	n, err := store.Put("file1", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Put wrote %d bytes, want %d", n, len(content))
+	}
+	if _, ok := fake.buckets["uploadfish"]["content/file1"]; !ok {
+		t.Error("object was not stored under the configured prefix")
+	}
+
+	if got := readBlob(t, store, "file1", 0); !bytes.Equal(got, content) {
+		t.Errorf("Get = %q, want %q", got, content)
+	}
+	if got := readBlob(t, store, "file1", 6); !bytes.Equal(got, content[6:]) {
+		t.Errorf("GetAt(6) = %q, want %q", got, content[6:])
+	}
+
+	info, err := store.Stat("file1")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Stat size = %d, want %d", info.Size, len(content))
+	}
+
+	var ids []string
+	if err := store.List(func(id string) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "file1" {
+		t.Errorf("List = %v, want [file1]", ids)
+	}
+
+	if err := store.Delete("file1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat("file1"); err != ErrNotFound {
+		t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3BlobStoreMissingObject(t *testing.T) {
+	store, _ := newTestS3BlobStore(t)
+
+	if _, err := store.Stat("missing"); err != ErrNotFound {
+		t.Errorf("Stat: got %v, want ErrNotFound", err)
+	}
+	if _, err := store.Get("missing"); err != ErrNotFound {
+		t.Errorf("Get: got %v, want ErrNotFound", err)
+	}
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("Delete: got %v, want nil", err)
+	}
+}
+
+func TestS3BlobStoreMultipartUpload(t *testing.T) {
+	store, fake := newTestS3BlobStore(t)
+
+	// Two full parts and a partial one
+	content := make([]byte, 2*s3PartSize+1234)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	// Hide the length so the upload streams like uploaded content does
+	n, err := store.Put("large", io.MultiReader(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n != int64(len(content)) {
+		t.Errorf("Put wrote %d bytes, want %d", n, len(content))
+	}
+	if fake.multipartUploads != 1 || fake.partsUploaded != 3 {
+		t.Errorf("got %d multipart uploads with %d parts, want 1 with 3", fake.multipartUploads, fake.partsUploaded)
+	}
+
+	if got := readBlob(t, store, "large", 0); !bytes.Equal(got, content) {
+		t.Error("multipart object content does not match")
+	}
+	offset := int64(s3PartSize + 100)
+	if got := readBlob(t, store, "large", offset); !bytes.Equal(got, content[offset:]) {
+		t.Error("ranged read across parts does not match")
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/prologic/bitcask"
+
+	"uploadfish/models"
+)
+
+// Prefix for chunked upload session entries in BitCask
+const sessionPrefix = "session:"
+
+// SaveUploadSession stores the state of a chunked upload
+func (s *Storage) SaveUploadSession(session *models.UploadSession) error {
+	data, err := session.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload session: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.db.Put([]byte(sessionPrefix+session.ID), data); err != nil {
+		return fmt.Errorf("failed to save upload session: %w", err)
+	}
+	return nil
+}
+
+// GetUploadSession retrieves the state of a chunked upload.
+// Returns ErrNotFound if there is no session for the ID.
+func (s *Storage) GetUploadSession(id string) (*models.UploadSession, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, err := s.db.Get([]byte(sessionPrefix + id))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+
+	session := &models.UploadSession{}
+	if err := session.FromJSON(data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload session: %w", err)
+	}
+	return session, nil
+}
+
+// DeleteUploadSession removes the state of a chunked upload
+func (s *Storage) DeleteUploadSession(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.db.Delete([]byte(sessionPrefix + id)); err != nil && err != bitcask.ErrKeyNotFound {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	return nil
+}
+
+// ListUploadSessions returns all stored chunked upload sessions
+func (s *Storage) ListUploadSessions() ([]*models.UploadSession, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var sessions []*models.UploadSession
+	err := s.db.Scan([]byte(sessionPrefix), func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			s.logger.Error(err, "Failed to get upload session during scan", map[string]interface{}{"key": string(key)})
+			return nil // Continue with next key
+		}
+
+		session := &models.UploadSession{}
+		if err := session.FromJSON(data); err != nil {
+			s.logger.Error(err, "Failed to parse upload session during scan", map[string]interface{}{"key": string(key)})
+			return nil // Continue with next key
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning upload sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// CountUploadSessions returns the number of stored chunked upload sessions
+// without reading them
+func (s *Storage) CountUploadSessions() (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	count := 0
+	err := s.db.Scan([]byte(sessionPrefix), func(key []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error scanning upload sessions: %w", err)
+	}
+	return count, nil
+}
@@ -1,22 +1,32 @@
 package storage
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/klauspost/compress/gzip"
 	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/flock"
+	"go.opentelemetry.io/otel/attribute"
 
 	"uploadfish/config"
+	"uploadfish/metrics"
 	"uploadfish/models"
+	"uploadfish/tracing"
 )
 
+// ErrClosed is returned by Ping after the storage has been closed
+var ErrClosed = errors.New("storage is closed")
+
+// errStopScan ends a Scan once the key it looks for is found
+var errStopScan = errors.New("stop scan")
+
 // Logger interface defines the logging methods needed by the storage package
 type Logger interface {
 	Error(err error, message string, fields map[string]interface{})
@@ -33,164 +43,339 @@ const (
 // Storage handles file metadata persistence and cleanup
 type Storage struct {
 	db        *bitcask.Bitcask
+	blobs     BlobStore
 	config    *config.Config
 	mutex     sync.RWMutex
 	closeOnce sync.Once
+	closed    atomic.Bool
 	logger    Logger
+
+	// Stop and wait for the cleanup routine
+	stopCleanup context.CancelFunc
+	cleanupDone chan struct{}
 }
 
-// New creates a new storage instance
-func New(cfg *config.Config, logger Logger) (*Storage, error) {
+// New creates a new storage instance. The expired file cleanup routine runs
+// until ctx is done or the storage is closed.
+func New(ctx context.Context, cfg *config.Config, logger Logger) (*Storage, error) {
+	s, err := Open(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start cleanup routine
+	ctx, s.stopCleanup = context.WithCancel(ctx)
+	s.cleanupDone = make(chan struct{})
+	go s.startCleanupRoutine(ctx)
+
+	return s, nil
+}
+
+// Open opens the storage without the cleanup routine, so expired files are
+// only removed by an explicit CleanupExpiredFiles
+func Open(cfg *config.Config, logger Logger) (*Storage, error) {
 	// Ensure the data directory exists
 	if err := os.MkdirAll(cfg.BitcaskPath, 0750); err != nil {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	// Calculate max value size based on max upload size plus some overhead for compression
-	if cfg.MaxUploadSize > math.MaxInt64-1024*1024 {
-		return nil, fmt.Errorf("max upload size is too large, would cause overflow")
+	db, err := openBitcask(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BitCask database: %w", err)
 	}
-	maxValueSize := uint64(cfg.MaxUploadSize + 1024*1024) // Add 1MB for overhead
 
-	// Open the BitCask database with increased max value size
-	db, err := bitcask.Open(
-		cfg.BitcaskPath,
-		bitcask.WithSync(true),
-		bitcask.WithMaxValueSize(maxValueSize),
-	)
+	// Create the content backend
+	blobs, err := newBlobStore(cfg, db)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open BitCask database: %w", err)
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize content backend: %w", err)
 	}
 
 	// Create storage instance
 	s := &Storage{
 		db:     db,
+		blobs:  blobs,
 		config: cfg,
 		logger: logger,
 	}
 
-	// Start cleanup routine
-	go s.startCleanupRoutine()
+	// Fail early on a misconfigured codec rather than on the first upload
+	if _, err := s.codecFor(s.compressionCodec()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("invalid compression codec: %w", err)
+	}
 
 	return s, nil
 }
 
-// SaveFile saves file metadata and streams content to the database
-func (s *Storage) SaveFile(fileMetadata *models.File, contentReader io.Reader) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// Bitcask value limits. Content is stored in segments, so the largest values
+// are a segment, an upload session with a hash for each of its chunks, and the
+// metadata of the largest file, whose frame index grows with its size.
+const (
+	// metadataHeadroom covers the fixed fields, encrypted sample and framing
+	metadataHeadroom = 1024 * 1024
+	// metadataBytesPerEntry bounds one chunk hash or frame offset in JSON
+	metadataBytesPerEntry = 128
+)
+
+// maxValueSize is the largest value written to Bitcask
+func maxValueSize(cfg *config.Config) uint64 {
+	entries := uint64(models.MaxUploadChunks) + uint64(cfg.MaxUploadSize/contentFrameSize+1)
+	return bitcaskSegmentSize + metadataHeadroom + entries*metadataBytesPerEntry
+}
+
+// legacyMaxValueSize is the limit of versions that stored each file's content
+// as a single value
+func legacyMaxValueSize(cfg *config.Config) uint64 {
+	return uint64(cfg.MaxUploadSize) + 1024*1024
+}
+
+// openBitcask opens the database with the smallest value limit its contents
+// allow. Bitcask also applies the limit when reading, so a database that
+// still holds content stored whole by older versions, or can't be indexed
+// with the smaller limit, is opened with the limit it was written with.
+func openBitcask(cfg *config.Config) (*bitcask.Bitcask, error) {
+	open := func(limit uint64) (*bitcask.Bitcask, error) {
+		return bitcask.Open(cfg.BitcaskPath, bitcask.WithSync(true), bitcask.WithMaxValueSize(limit))
+	}
 
+	db, err := open(maxValueSize(cfg))
+	if errors.Is(err, bitcask.ErrDatabaseLocked) || errors.Is(err, flock.ErrLockFailed) {
+		return nil, err
+	}
+	if err == nil {
+		legacy := false
+		scanErr := db.Scan([]byte(contentPrefix), func(key []byte) error {
+			legacy = true
+			return errStopScan
+		})
+		if scanErr != nil && scanErr != errStopScan {
+			_ = db.Close()
+			return nil, scanErr
+		}
+		if !legacy {
+			return db, nil
+		}
+		if err := db.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return open(max(maxValueSize(cfg), legacyMaxValueSize(cfg)))
+}
+
+// SaveFile streams content to the content backend and then saves the file
+// metadata. Content is written without holding the storage lock so that
+// concurrent large uploads do not serialise behind each other, and metadata is
+// written last so a file never becomes visible before its content is stored.
+func (s *Storage) SaveFile(ctx context.Context, fileMetadata *models.File, contentReader io.Reader) (err error) {
 	// Generate UUID if not set
 	if fileMetadata.ID == "" {
 		fileMetadata.ID = uuid.New().String()
 	}
 
+	ctx, span := tracing.Start(ctx, "storage.SaveFile", tracing.FileIDKey.String(fileMetadata.ID))
+	defer func() { tracing.End(span, err) }()
+
 	// Set upload time if not set
 	if fileMetadata.UploadTime.IsZero() {
 		fileMetadata.UploadTime = time.Now()
 	}
 
+	// Save content by streaming and compressing
+	if contentReader != nil {
+		_, codecSpan := tracing.Start(ctx, "storage.chooseCodec")
+		codecName, reader, err := s.chooseCodec(fileMetadata, contentReader)
+		codecSpan.SetAttributes(tracing.CodecKey.String(codecName))
+		tracing.End(codecSpan, err)
+		if err != nil {
+			return err
+		}
+
+		_, compressSpan := tracing.Start(ctx, "storage.compress", tracing.CodecKey.String(codecName),
+			attribute.String("uploadfish.storage_backend", s.config.StorageBackend))
+		compressedSize, written, index, err := s.putEncoded(fileMetadata.ID, reader, codecName)
+		compressSpan.SetAttributes(tracing.FileSizeKey.Int64(written), attribute.Int64("uploadfish.compressed_size", compressedSize))
+		tracing.End(compressSpan, err)
+		if err != nil {
+			return err
+		}
+		fileMetadata.Codec = codecName
+		fileMetadata.ContentFrameSize = contentFrameSize
+		fileMetadata.ContentIndex = index
+
+		// The stored size is what was actually read, which streamed uploads
+		// of unknown length only learn here
+		if fileMetadata.Size != written {
+			s.logger.Info("Correcting file size to bytes read", map[string]interface{}{
+				"file_id":       fileMetadata.ID,
+				"declared_size": fileMetadata.Size,
+				"bytes_read":    written,
+			})
+			fileMetadata.Size = written
+		}
+
+		s.logger.Info("Compressed content stream", map[string]interface{}{
+			"file_id":         fileMetadata.ID,
+			"codec":           codecName,
+			"original_size":   fileMetadata.Size,
+			"compressed_size": compressedSize,
+		})
+	}
+
 	// Convert metadata to JSON
 	metadataKey := []byte(metadataPrefix + fileMetadata.ID)
 	metadataValue, err := fileMetadata.ToJSON()
 	if err != nil {
+		_ = s.blobs.Delete(fileMetadata.ID) // Rollback content
 		return fmt.Errorf("failed to marshal file metadata: %w", err)
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	// Save metadata to database
-	if err := s.db.Put(metadataKey, metadataValue); err != nil {
+	_, putSpan := tracing.Start(ctx, "bitcask.Put", attribute.Int("uploadfish.value_size", len(metadataValue)))
+	err = s.db.Put(metadataKey, metadataValue)
+	tracing.End(putSpan, err)
+	if err != nil {
+		_ = s.blobs.Delete(fileMetadata.ID) // Rollback content
 		return fmt.Errorf("failed to save file metadata: %w", err)
 	}
 
-	// Save content by streaming and compressing
-	if contentReader != nil {
-		contentKey := []byte(contentPrefix + fileMetadata.ID)
+	span.SetAttributes(tracing.FileSizeKey.Int64(fileMetadata.Size))
+	return nil
+}
 
-		// Use a pipe to connect the gzip writer to an io.Reader for Bitcask
-		// Alternatively, buffer in memory if Bitcask needs a byte slice.
-		// Let's buffer for simplicity with Bitcask Put, but acknowledge this
-		// still uses memory proportional to the *compressed* size.
-		var compressedBuf bytes.Buffer
-		gz := gzip.NewWriter(&compressedBuf)
+// putEncoded encodes the content on the fly and streams it into the content
+// backend through a pipe, so backends that can stream never hold the whole
+// file in memory. The content is written as independent frames (see
+// writeFrames); it returns the encoded and original sizes and the frame index.
+func (s *Storage) putEncoded(id string, contentReader io.Reader, codecName string) (int64, int64, []int64, error) {
+	c, err := s.codecFor(codecName)
+	if err != nil {
+		return 0, 0, nil, err
+	}
 
-		// Copy from the source reader, through gzip, into the buffer
-		written, err := io.Copy(gz, contentReader)
-		if err != nil {
-			_ = s.db.Delete(metadataKey) // Rollback metadata
-			return fmt.Errorf("failed during file content compression: %w", err)
-		}
-		if err := gz.Close(); err != nil { // Important: Close gzip writer
-			_ = s.db.Delete(metadataKey)
-			return fmt.Errorf("failed to compress file content: %w", err)
-		}
+	pr, pw := io.Pipe()
 
-		s.logger.Info("Compressed content stream", map[string]interface{}{
-			"file_id":               fileMetadata.ID,
-			"original_size":         fileMetadata.Size, // Assuming this was set correctly before calling
-			"compressed_size":       compressedBuf.Len(),
-			"bytes_written_to_gzip": written,
-		})
-
-		// Save compressed content buffer to database
-		if err := s.db.Put(contentKey, compressedBuf.Bytes()); err != nil {
-			// Try to delete metadata if content save fails
-			_ = s.db.Delete(metadataKey)
-			return fmt.Errorf("failed to save file content: %w", err)
-		}
+	type compressResult struct {
+		written int64
+		index   []int64
+		err     error
+	}
+	done := make(chan compressResult, 1)
+
+	go func() {
+		// Copy from the source reader, through the encoder, into the pipe
+		written, index, err := writeFrames(pw, contentReader, c)
+		pw.CloseWithError(err)
+		done <- compressResult{written: written, index: index, err: err}
+	}()
+
+	compressedSize, putErr := s.blobs.Put(id, pr)
+	// Unblock the compressor if the backend stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	result := <-done
+
+	if putErr != nil {
+		_ = s.blobs.Delete(id)
+		return 0, 0, nil, fmt.Errorf("failed to save file content: %w", putErr)
+	}
+	if result.err != nil {
+		_ = s.blobs.Delete(id)
+		return 0, 0, nil, result.err
 	}
 
-	return nil
+	return compressedSize, result.written, result.index, nil
 }
 
-// GetFile retrieves file metadata by ID
+// GetFile retrieves file metadata by ID.
+// Returns ErrNotFound if there is no such file.
 func (s *Storage) GetFile(id string) (*models.File, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	// Get metadata from database
-	metadataKey := []byte(metadataPrefix + id)
-	data, err := s.db.Get(metadataKey)
+	return s.getFileLocked(id)
+}
+
+// GetFileContentStream retrieves a reader for the decompressed file content by ID.
+// The caller is responsible for closing the returned io.ReadCloser.
+// Content is streamed from the backend, so memory use does not grow with file size.
+// Returns ErrNotFound if no content is stored for the ID.
+func (s *Storage) GetFileContentStream(id string) (io.ReadCloser, error) {
+	fileMetadata, err := s.GetFile(id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file metadata: %w", err)
+		return nil, err
 	}
+	return s.GetFileContentRange(fileMetadata, 0)
+}
 
-	// Parse JSON
-	file := &models.File{}
-	if err := file.FromJSON(data); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal file metadata: %w", err)
-	}
+// decompressingReader closes both the decoder and the underlying content stream
+type decompressingReader struct {
+	io.Reader
+	decoder io.Closer
+	source  io.Closer
+}
 
-	return file, nil
+// Close closes the decoder and then the underlying content stream
+func (d *decompressingReader) Close() error {
+	decErr := d.decoder.Close()
+	if err := d.source.Close(); err != nil {
+		return err
+	}
+	return decErr
 }
 
-// GetFileContentStream retrieves a reader for the decompressed file content by ID.
+// GetFileContentRange retrieves a reader for the decompressed file content
+// starting at the given offset. Files stored with a frame index only decode
+// the frame containing the offset; older files are decoded from the start.
 // The caller is responsible for closing the returned io.ReadCloser.
-// This reads the compressed data into memory but streams the decompression.
-func (s *Storage) GetFileContentStream(id string) (io.ReadCloser, error) {
-	s.mutex.RLock() // Lock for reading from DB
-	// Get compressed content from database
-	contentKey := []byte(contentPrefix + id)
-	compressedData, err := s.db.Get(contentKey)
-	s.mutex.RUnlock() // Unlock BEFORE returning the reader
+func (s *Storage) GetFileContentRange(fileMetadata *models.File, offset int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > fileMetadata.Size {
+		return nil, fmt.Errorf("invalid content offset %d", offset)
+	}
 
-	if err != nil {
-		if err == bitcask.ErrKeyNotFound {
-			return nil, err // Return specific error for not found
+	// Find the frame containing the offset
+	var encodedOffset, skip int64 = 0, offset
+	if fileMetadata.ContentFrameSize > 0 && len(fileMetadata.ContentIndex) > 0 {
+		frame := offset / fileMetadata.ContentFrameSize
+		if frame >= int64(len(fileMetadata.ContentIndex)) {
+			frame = int64(len(fileMetadata.ContentIndex)) - 1
 		}
-		return nil, fmt.Errorf("failed to get file content stream: %w", err)
+		encodedOffset = fileMetadata.ContentIndex[frame]
+		skip = offset - frame*fileMetadata.ContentFrameSize
 	}
 
-	// Create a reader for the compressed data
-	compressedReader := bytes.NewReader(compressedData)
+	s.mutex.RLock()
+	compressedReader, err := s.blobs.GetAt(fileMetadata.ID, encodedOffset)
+	s.mutex.RUnlock()
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get file content range: %w", err)
+	}
 
-	// Create a gzip reader to decompress on the fly
-	gzReader, err := gzip.NewReader(compressedReader)
+	// Decode with the codec recorded when the file was stored
+	c, err := s.codecFor(fileMetadata.Codec)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		_ = compressedReader.Close()
+		return nil, err
+	}
+	decoder, err := c.newDecoder(compressedReader)
+	if err != nil {
+		_ = compressedReader.Close()
+		return nil, fmt.Errorf("failed to create decoder: %w", err)
+	}
+	reader := &decompressingReader{Reader: decoder, decoder: decoder, source: compressedReader}
+
+	// Decode and discard up to the requested offset within the frame
+	if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("failed to seek file content: %w", err)
 	}
 
-	// gzReader is an io.ReadCloser, return it directly
-	return gzReader, nil
+	return reader, nil
 }
 
 // DeleteFile removes file metadata and content
@@ -205,8 +390,7 @@ func (s *Storage) DeleteFile(id string) error {
 	}
 
 	// Delete content
-	contentKey := []byte(contentPrefix + id)
-	if err := s.db.Delete(contentKey); err != nil && err != bitcask.ErrKeyNotFound {
+	if err := s.blobs.Delete(id); err != nil {
 		return fmt.Errorf("failed to delete file content: %w", err)
 	}
 
@@ -272,7 +456,9 @@ func (s *Storage) CleanupExpiredFiles() error {
 				"file_id": id,
 			})
 			// Continue with next file even if this one fails
+			continue
 		}
+		metrics.ExpiredFilesRemoved.Inc()
 	}
 
 	if len(expiredIDs) > 0 {
@@ -306,23 +492,48 @@ func (s *Storage) Stats() (bitcask.Stats, error) {
 	return s.db.Stats()
 }
 
-// startCleanupRoutine starts a background goroutine to clean up expired files
-func (s *Storage) startCleanupRoutine() {
+// startCleanupRoutine periodically cleans up expired files until ctx is done
+func (s *Storage) startCleanupRoutine(ctx context.Context) {
+	defer close(s.cleanupDone)
 	ticker := time.NewTicker(s.config.CleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		if err := s.CleanupExpiredFiles(); err != nil {
 			s.logger.Error(err, "Error during cleanup", nil)
 		}
 	}
 }
 
-// Close closes the database
+// Close stops the cleanup routine, if running, waiting for a cleanup in
+// progress to finish, and closes the database
 func (s *Storage) Close() error {
 	var err error
 	s.closeOnce.Do(func() {
+		if s.stopCleanup != nil {
+			s.stopCleanup()
+			<-s.cleanupDone
+		}
+		s.closed.Store(true)
 		err = s.db.Close()
 	})
 	return err
 }
+
+// Ping checks that the database is open and can be written, by syncing it
+// to disk. Returns ErrClosed after Close.
+func (s *Storage) Ping() error {
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	if err := s.db.Sync(); err != nil {
+		return fmt.Errorf("failed to sync database: %w", err)
+	}
+	return nil
+}
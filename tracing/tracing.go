@@ -0,0 +1,106 @@
+// Package tracing sets up OpenTelemetry tracing and exports spans over OTLP
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer and the default service name
+const tracerName = "uploadfish"
+
+// Attribute keys shared by handler and storage spans
+const (
+	FileIDKey     = attribute.Key("uploadfish.file.id")
+	FileSizeKey   = attribute.Key("uploadfish.file.size")
+	ChunkIndexKey = attribute.Key("uploadfish.chunk.index")
+	ChunkSizeKey  = attribute.Key("uploadfish.chunk.size")
+	CodecKey      = attribute.Key("uploadfish.codec")
+	RequestIDKey  = attribute.Key("http.request.id")
+)
+
+// Setup installs a tracer provider exporting spans over OTLP/HTTP. The
+// exporter and sampler are configured with the standard OTEL_* environment
+// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_TRACES_SAMPLER. The
+// returned function flushes and stops the exporter.
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(tracerName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a copy of ctx whose spans record the request ID, so
+// every span of a request can be found from its X-Request-ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// withRequestID adds the request ID in the context, if any, to attrs
+func withRequestID(ctx context.Context, attrs []attribute.KeyValue) []attribute.KeyValue {
+	if requestID, _ := ctx.Value(requestIDContextKey{}).(string); requestID != "" {
+		attrs = append(attrs, RequestIDKey.String(requestID))
+	}
+	return attrs
+}
+
+// Start starts a span as a child of any span in the context. Without Setup
+// the global provider is a no-op, so spans cost almost nothing.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(withRequestID(ctx, attrs)...))
+}
+
+// StartServer starts the span for an incoming request
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(withRequestID(ctx, attrs)...), trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace in the context, or "" if there is none
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
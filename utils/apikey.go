@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"uploadfish/models"
+)
+
+// APIKeyPrefix starts every generated API key, making keys easy to recognise
+// in configuration and secret scanners
+const APIKeyPrefix = "uf_"
+
+type apiKeyContextKey struct{}
+
+// WithAPIKey returns a copy of ctx carrying the authenticated API key
+func WithAPIKey(ctx context.Context, key *models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the API key that authenticated the request, or
+// nil for anonymous requests
+func APIKeyFromContext(ctx context.Context) *models.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*models.APIKey)
+	return key
+}
+
+// GenerateAPIKey creates a new secret API key
+func GenerateAPIKey() (string, error) {
+	secret, err := GenerateRandomString(40)
+	if err != nil {
+		return "", err
+	}
+	return APIKeyPrefix + secret, nil
+}
+
+// NewAPIKey generates a new API key with the given name, returning the key
+// to store and its secret, which is shown to the user once
+func NewAPIKey(name string) (*models.APIKey, string, error) {
+	secret, err := GenerateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	keyHash := HashToken(secret)
+	return &models.APIKey{
+		ID:        models.APIKeyID(keyHash),
+		Name:      name,
+		KeyHash:   keyHash,
+		CreatedAt: time.Now().UTC(),
+	}, secret, nil
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header, or
+// an empty string if there is none
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -1,15 +1,19 @@
 package utils
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
+
+	"uploadfish/metrics"
 )
 
 // CSRFProtection provides protection against Cross-Site Request Forgery attacks
@@ -31,8 +35,9 @@ type TokenPair struct {
 	CookieToken string
 }
 
-// NewCSRFProtection creates a new CSRF protection handler
-func NewCSRFProtection(expiration time.Duration, logger Logger) *CSRFProtection {
+// NewCSRFProtection creates a new CSRF protection handler. Its cleanup
+// routine stops when ctx is done.
+func NewCSRFProtection(ctx context.Context, expiration time.Duration, logger Logger) *CSRFProtection {
 	csrf := &CSRFProtection{
 		tokens:     make(map[string]time.Time),
 		expiration: expiration,
@@ -40,7 +45,7 @@ func NewCSRFProtection(expiration time.Duration, logger Logger) *CSRFProtection
 	}
 
 	// Start cleanup routine
-	go csrf.startCleanup()
+	go csrf.startCleanup(ctx)
 
 	return csrf
 }
@@ -136,12 +141,18 @@ func (c *CSRFProtection) SetTokenCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, cookie)
 }
 
-// startCleanup periodically removes expired tokens
-func (c *CSRFProtection) startCleanup() {
+// startCleanup periodically removes expired tokens until ctx is done
+func (c *CSRFProtection) startCleanup(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		c.mu.Lock()
 		now := time.Now()
 
@@ -158,8 +169,9 @@ func (c *CSRFProtection) startCleanup() {
 // Middleware returns a middleware function that validates CSRF tokens
 func (c *CSRFProtection) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip CSRF check for GET requests and static resources
-		if r.Method == "GET" || strings.HasPrefix(r.URL.Path, "/static/") {
+		// Skip CSRF check for GET requests, static resources and requests
+		// authenticated with an API key, which carry no cookies to forge
+		if r.Method == "GET" || strings.HasPrefix(r.URL.Path, "/static/") || APIKeyFromContext(r.Context()) != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -167,6 +179,7 @@ func (c *CSRFProtection) Middleware(next http.Handler) http.Handler {
 		// Get cookie token
 		cookie, err := r.Cookie("csrf_token")
 		if err != nil {
+			metrics.CSRFRejections.Inc()
 			c.logger.Info("CSRF validation failed - no cookie", map[string]interface{}{
 				"method":      r.Method,
 				"path":        r.URL.Path,
@@ -223,6 +236,7 @@ func (c *CSRFProtection) Middleware(next http.Handler) http.Handler {
 		}
 
 		// No valid token found - return a CSRF error
+		metrics.CSRFRejections.Inc()
 		c.logger.Info("CSRF validation failed", map[string]interface{}{
 			"method":      r.Method,
 			"path":        r.URL.Path,
@@ -258,3 +272,10 @@ func GenerateHMAC(secret string, message string) string {
 	expectedMAC := mac.Sum(nil)
 	return base64.StdEncoding.EncodeToString(expectedMAC)
 }
+
+// HashToken returns the hex encoded SHA-256 hash of a secret token, for
+// storing tokens without keeping the secret itself
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// FreeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem holding path
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space can't be read on this platform")
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -19,8 +20,9 @@ type ipRequests struct {
 	lastSeen time.Time
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter(maxRequests int, windowLength, cleanup time.Duration) *RateLimiter {
+// NewRateLimiter creates a new rate limiter. Its cleanup routine stops when
+// ctx is done.
+func NewRateLimiter(ctx context.Context, maxRequests int, windowLength, cleanup time.Duration) *RateLimiter {
 	limiter := &RateLimiter{
 		requests:     make(map[string]*ipRequests),
 		maxRequests:  maxRequests,
@@ -29,7 +31,7 @@ func NewRateLimiter(maxRequests int, windowLength, cleanup time.Duration) *RateL
 	}
 
 	// Start cleanup routine
-	go limiter.startCleanup()
+	go limiter.startCleanup(ctx)
 
 	return limiter
 }
@@ -66,12 +68,18 @@ func (rl *RateLimiter) Allow(ipAddr string) bool {
 	return req.count <= rl.maxRequests
 }
 
-// startCleanup periodically removes old entries
-func (rl *RateLimiter) startCleanup() {
+// startCleanup periodically removes old entries until ctx is done
+func (rl *RateLimiter) startCleanup(ctx context.Context) {
 	ticker := time.NewTicker(rl.cleanup)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		rl.mu.Lock()
 		now := time.Now()
 